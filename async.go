@@ -1,46 +1,111 @@
 package wd
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/reddec/wd/internal"
 )
 
-func (wh *Webhooks) enqueueWebhook(req *http.Request, manifest *Manifest) error {
+const drainCheckInterval = 100 * time.Millisecond
+
+// oldestQueuedTimeout is maximum time to get the oldest queued item for metrics.
+const oldestQueuedTimeout = time.Second
+
+// requeueTimeout is maximum time to return item, popped after worker stopped, back to queue.
+const requeueTimeout = 5 * time.Second
+
+// enqueueWebhook stores request and pushes it to queue. Returns task ID if tasks are tracked (see Config.Tasks).
+func (wh *Webhooks) enqueueWebhook(req *http.Request, manifest *Manifest) (string, error) {
+	var taskID string
+	if wh.config.Tasks != nil {
+		id, err := newTaskID()
+		if err != nil {
+			return "", err
+		}
+		taskID = id
+	}
+
 	// dump request
-	tmpFile, err := ioutil.TempFile("", "")
+	requestFile, err := wh.storeRequest(req)
 	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
+		return "", err
 	}
 
-	if err := req.Write(tmpFile); err != nil {
-		_ = tmpFile.Close()
-		_ = os.RemoveAll(tmpFile.Name())
-		return fmt.Errorf("serialize request: %w", err)
+	if wh.config.AsyncNice != 0 {
+		lowered := *manifest
+		lowered.Nice += wh.config.AsyncNice
+		if lowered.Nice > MaxNice {
+			lowered.Nice = MaxNice
+		}
+		manifest = &lowered
 	}
 
-	if err := tmpFile.Close(); err != nil {
-		_ = os.RemoveAll(tmpFile.Name())
-		return fmt.Errorf("close temp file: %w", err)
+	item := &QueuedWebhook{
+		RequestFile: requestFile,
+		Path:        req.URL.Path,
+		Manifest:    manifest,
+		RemoteAddr:  req.RemoteAddr,
+		TLS:         req.TLS != nil,
+		TaskID:      taskID,
+		Enqueued:    time.Now(),
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		item.ClientCert = req.TLS.VerifiedChains[0][0].Raw
 	}
 
+	// status should exist before worker picks the task
+	wh.setTaskState(req.Context(), item, TaskQueued, 0, nil)
+
 	// add to queue
-	if err := wh.queue.Push(req.Context(), &QueuedWebhook{
-		RequestFile: tmpFile.Name(),
-		Manifest:    manifest,
-	}); err != nil {
+	if err := wh.queue.Push(req.Context(), item); err != nil {
+		_ = os.RemoveAll(requestFile)
+		wh.setTaskState(req.Context(), item, TaskFailed, 0, err)
+		return "", fmt.Errorf("push to queue: %w", err)
+	}
+	if !wh.sharedQueue {
+		atomic.AddInt64(&wh.pending, 1)
+		wh.queuedNum.Inc()
+	}
+	return taskID, nil
+}
+
+// storeRequest serializes request to file in Config.QueueDir and returns file name. Number of concurrent
+// serializations is limited by Config.MaxSpooling.
+func (wh *Webhooks) storeRequest(req *http.Request) (string, error) {
+	if wh.spooling != nil {
+		if err := wh.spooling.Acquire(req.Context(), 1); err != nil {
+			return "", fmt.Errorf("wait for serialization: %w", err)
+		}
+		defer wh.spooling.Release(1)
+	}
+
+	tmpFile, err := ioutil.TempFile(wh.config.QueueDir, "")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+
+	if err := wh.config.Codec.Encode(tmpFile, req); err != nil {
+		_ = tmpFile.Close()
 		_ = os.RemoveAll(tmpFile.Name())
-		return fmt.Errorf("push to queue: %w", err)
+		return "", fmt.Errorf("serialize request: %w", err)
 	}
-	wh.queuedNum.Inc()
-	return nil
+
+	if err := tmpFile.Close(); err != nil {
+		_ = os.RemoveAll(tmpFile.Name())
+		return "", fmt.Errorf("close temp file: %w", err)
+	}
+	return tmpFile.Name(), nil
 }
 
 // Run single worker to process background tasks in queue. Can be invoked several times to increase performance.
@@ -53,64 +118,336 @@ func (wh *Webhooks) Run(ctx context.Context) {
 		if err != nil {
 			return
 		}
-		wh.queuedNum.Dec()
-		tmpFile, err := wh.openStoredRequestFile(enqueuedItem)
-		if err != nil {
-			log.Println("failed to process", enqueuedItem.RequestFile, "-", err)
-			continue
+		if ctx.Err() != nil {
+			// popped concurrently with stop, so item can not be processed (see requeue)
+			wh.requeue(enqueuedItem)
+			return
+		}
+		atomic.AddInt64(&wh.processing, 1)
+		if !wh.sharedQueue {
+			// items in shared queue may be pushed by other instances
+			atomic.AddInt64(&wh.pending, -1)
+			wh.queuedNum.Dec()
 		}
+		if !enqueuedItem.Enqueued.IsZero() {
+			wh.queueWait.Observe(time.Since(enqueuedItem.Enqueued).Seconds())
+		}
+		wh.processQueuedWebhook(ctx, enqueuedItem)
+		atomic.AddInt64(&wh.processing, -1)
+	}
+}
 
-		wh.processRequestAsync(ctx, enqueuedItem.Manifest, tmpFile)
-		_ = tmpFile.Close()
-		_ = os.RemoveAll(tmpFile.Name())
+// requeue returns item, which was popped after worker stopped, back to queue, so it could be processed by other
+// workers or instances (shared queue).
+func (wh *Webhooks) requeue(item *QueuedWebhook) {
+	ctx, cancel := context.WithTimeout(context.Background(), requeueTimeout)
+	defer cancel()
+	if err := wh.queue.Push(ctx, item); err != nil {
+		wh.config.Logger.Error("failed return item to queue, item lost", "file", item.RequestFile, "error", err)
+	}
+}
+
+// startWorkers starts async workers defined by Config.AutoStartWorkers.
+func (wh *Webhooks) startWorkers() {
+	if wh.config.AutoStartWorkers <= 0 {
+		return
+	}
+	parent := wh.config.WorkersContext
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	wh.stopWorkers = cancel
+	for i := 0; i < wh.config.AutoStartWorkers; i++ {
+		wh.workers.Add(1)
+		go func() {
+			defer wh.workers.Done()
+			wh.Run(ctx)
+		}()
+	}
+}
+
+// Close stops workers started by New (see Config.AutoStartWorkers) and waits till they finished. In-progress async
+// tasks are interrupted, so Drain should be called before Close for graceful shutdown. Manually started workers are
+// not affected. Safe to call multiple times.
+func (wh *Webhooks) Close() error {
+	if wh.stopWorkers != nil {
+		wh.stopWorkers()
+	}
+	wh.workers.Wait()
+	return nil
+}
+
+func (wh *Webhooks) processQueuedWebhook(ctx context.Context, enqueuedItem *QueuedWebhook) {
+	tmpFile, err := wh.openStoredRequestFile(enqueuedItem)
+	if err != nil {
+		wh.config.Logger.Error("failed to process stored request", "file", enqueuedItem.RequestFile, "error", err)
+		wh.completeTask(ctx, enqueuedItem, TaskFailed, 0, err)
+		return
 	}
+	defer os.RemoveAll(tmpFile.Name())
+	defer tmpFile.Close()
+
+	wh.processRequestAsync(ctx, enqueuedItem, tmpFile)
 }
 
-func (wh *Webhooks) processRequestAsync(ctx context.Context, manifest *Manifest, tmpFile *os.File) {
+// StartWorkers runs n async workers (see Run) in background till context canceled. Returned function waits till
+// all workers stopped.
+func (wh *Webhooks) StartWorkers(ctx context.Context, n int) (wait func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wh.config.Logger.Info("worker started", "worker", i)
+			wh.Run(ctx)
+		}(i)
+	}
+	return wg.Wait
+}
+
+// Drain waits till all queued and in-progress async tasks processed or context canceled. Workers (Run) should
+// be alive during draining. For shared queue (see RedisQueue) only in-progress tasks are awaited: queued tasks
+// stay in queue for other instances.
+func (wh *Webhooks) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for wh.Pending() > 0 || atomic.LoadInt64(&wh.processing) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// oldestQueued returns age of the oldest item in queue in seconds in case queue supports it (has
+// Oldest(context.Context) (time.Time, error) method). Returns zero for empty queue and for other queues.
+func (wh *Webhooks) oldestQueued() float64 {
+	oldest, ok := wh.queue.(interface {
+		Oldest(context.Context) (time.Time, error)
+	})
+	if !ok {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oldestQueuedTimeout)
+	defer cancel()
+	enqueued, err := oldest.Oldest(ctx)
+	if err != nil {
+		wh.config.Logger.Warn("failed get oldest queued item", "error", err)
+		return 0
+	}
+	if enqueued.IsZero() {
+		return 0
+	}
+	return time.Since(enqueued).Seconds()
+}
+
+// isSharedQueue returns true if queue is shared between several instances (has Shared() bool method, which
+// returns true).
+func isSharedQueue(queue Queue) bool {
+	shared, ok := queue.(interface{ Shared() bool })
+	return ok && shared.Shared()
+}
+
+// PingQueue checks that queue is reachable in case queue supports health checks (has Ping(context.Context) error
+// method). Always succeeds for other queues.
+func (wh *Webhooks) PingQueue(ctx context.Context) error {
+	if pinger, ok := wh.queue.(interface{ Ping(context.Context) error }); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Pending returns number of tasks pushed to queue by this instance, but not yet picked by workers. Always zero
+// for shared queue (see RedisQueue), since tasks could be picked by workers of other instances.
+func (wh *Webhooks) Pending() int64 {
+	return atomic.LoadInt64(&wh.pending)
+}
+
+func (wh *Webhooks) processRequestAsync(ctx context.Context, item *QueuedWebhook, tmpFile *os.File) {
+	path, manifest := item.Path, item.Manifest
 	wh.processingNum.Inc()
 	defer wh.processingNum.Dec()
 
+	// lifetime includes time spent in queue
+	started := item.Enqueued
+	if started.IsZero() {
+		started = time.Now()
+	}
+	var lastErr error
+	var attempts uint
 	var i uint
 	for i = 0; i <= manifest.Retries; i++ {
-		err := wh.processRequestAsyncAttempt(ctx, tmpFile, manifest, i)
+		if lifetime := wh.config.MaxAsyncLifetime; lifetime > 0 && time.Since(started) >= lifetime {
+			wh.config.Logger.Warn("async request lifetime exceeded, retries stopped",
+				"path", path,
+				"file", tmpFile.Name(),
+				"attempt", i+1,
+				"lifetime", lifetime)
+			break
+		}
+		attempts = i + 1
+		wh.setTaskState(ctx, item, TaskRunning, attempts, lastErr)
+		retryAfter, err := wh.processRequestAsyncAttempt(ctx, tmpFile, item, i)
 		if err == nil {
-			log.Println(i+1, "/", manifest.Retries+1, "successfully processed async request")
+			wh.retries.Deposit(path)
+			wh.completeTask(ctx, item, TaskSucceeded, attempts, nil)
+			wh.asyncSuccess.WithLabelValues(wh.metricsPath(path)).Inc()
+			wh.config.Logger.Info("successfully processed async request",
+				"path", path,
+				"file", tmpFile.Name(),
+				"attempt", i+1,
+				"attempts", manifest.Retries+1)
 			return
 		}
-		log.Println(i+1, "/", manifest.Retries+1, "failed to process async request:", err)
+		wh.config.Logger.Warn("failed to process async request",
+			"path", path,
+			"file", tmpFile.Name(),
+			"attempt", i+1,
+			"attempts", manifest.Retries+1,
+			"exit_code", exitStatus(err),
+			"error", err)
+		lastErr = err
+		if wh.isPermanentFailure(err) {
+			wh.config.Logger.Warn("permanent failure, retries stopped", "path", path, "file", tmpFile.Name())
+			break
+		}
+		if i < manifest.Retries && !wh.retries.Withdraw(path) {
+			wh.budgetSpent.WithLabelValues(wh.metricsPath(path)).Inc()
+			wh.config.Logger.Warn("retry budget exhausted, retries stopped", "path", path, "file", tmpFile.Name())
+			break
+		}
 		if i < manifest.Retries {
+			backoff := manifest.Backoff.Delay(manifest.Delay, i)
+			delay := wh.retryDelay(backoff, retryAfter, err)
+			if delay != backoff {
+				wh.config.Logger.Info("script requested retry delay", "path", path, "file", tmpFile.Name(), "delay", delay)
+			}
+			if lifetime := wh.config.MaxAsyncLifetime; lifetime > 0 && delay > lifetime-time.Since(started) {
+				delay = lifetime - time.Since(started)
+			}
+			wh.setTaskState(ctx, item, TaskRetrying, attempts, err)
 			wh.waitingForRetryNum.Inc()
 			select {
 			case <-ctx.Done():
 				wh.waitingForRetryNum.Dec()
 				return
-			case <-time.After(manifest.Delay):
+			case <-time.After(delay):
 			}
 			wh.waitingForRetryNum.Dec()
 		}
 	}
-	log.Println("async processing failed after all attempts")
+	wh.completeTask(ctx, item, TaskFailed, attempts, lastErr)
+	wh.asyncFailed.WithLabelValues(wh.metricsPath(path)).Inc()
+	wh.config.Logger.Error("async processing failed after all attempts", "path", path, "file", tmpFile.Name())
+}
+
+// isPermanentFailure returns true if script exited with Config.NoRetryExitCode or request body can not be passed to
+// script (ErrBinaryBody).
+func (wh *Webhooks) isPermanentFailure(err error) bool {
+	if errors.Is(err, ErrBinaryBody) {
+		return true
+	}
+	if wh.config.NoRetryExitCode == 0 {
+		return false
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == wh.config.NoRetryExitCode
+}
+
+// retryDelay returns delay before the next attempt: requested by script (see Config.MaxRetryAfter) or default.
+func (wh *Webhooks) retryDelay(delay time.Duration, retryAfter time.Duration, err error) time.Duration {
+	maxDelay := wh.config.MaxRetryAfter
+	if maxDelay <= 0 {
+		return delay
+	}
+	if code := wh.config.BackoffExitCode; code != 0 && exitStatus(err) == code {
+		return maxDelay
+	}
+	if retryAfter <= 0 {
+		return delay
+	}
+	if retryAfter > maxDelay {
+		return maxDelay
+	}
+	return retryAfter
 }
 
-func (wh *Webhooks) processRequestAsyncAttempt(ctx context.Context, tmpFile *os.File, manifest *Manifest, attempt uint) error {
+// processRequestAsyncAttempt invokes webhook once and returns delay requested by script in Retry-After header (zero if
+// not set).
+func (wh *Webhooks) processRequestAsyncAttempt(ctx context.Context, tmpFile *os.File, item *QueuedWebhook, attempt uint) (time.Duration, error) {
 	if _, err := tmpFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("reset temp file: %w", err)
+		return 0, fmt.Errorf("reset temp file: %w", err)
 	}
 
-	reader := bufio.NewReader(tmpFile)
-	req, err := http.ReadRequest(reader)
+	req, err := wh.config.Codec.Decode(tmpFile)
 	if err != nil {
-		return fmt.Errorf("read request from temp file: %w", err)
+		return 0, fmt.Errorf("read request from temp file: %w", err)
 	}
 	req = req.WithContext(ctx)
+	if err := item.restore(req); err != nil {
+		return 0, fmt.Errorf("restore request: %w", err)
+	}
 	req.Header.Set("X-Attempt", strconv.FormatUint(uint64(attempt+1), 10))
 
+	release, err := wh.acquireRunning(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire execution slot: %w", err)
+	}
+	defer release()
+
 	res := &nopWriter{}
-	if err := wh.invokeWebhook(res, req, manifest); err != nil {
-		return fmt.Errorf("attempt %d: %w", attempt, err)
+	if wh.config.IsSuccess != nil {
+		res.output = internal.NewTailBuffer(outputTailSize)
+	}
+	started := time.Now()
+	err = wh.invokeWebhook(res, req, item.Manifest)
+	if wh.config.IsSuccess != nil {
+		err = wh.checkSuccess(ExecutionInfo{
+			Path:     req.URL.Path,
+			Attempt:  attempt + 1,
+			ExitCode: exitStatus(err),
+			Status:   res.status,
+			Headers:  res.Header(),
+			Output:   res.output.Bytes(),
+			Duration: time.Since(started),
+			Err:      err,
+		})
+	}
+	if err != nil {
+		wh.lastErrors.Record(req.URL.Path, err)
+		return parseRetryAfter(res.Header().Get("Retry-After")), fmt.Errorf("attempt %d: %w", attempt, err)
 	}
 
-	return nil
+	return 0, nil
+}
+
+// checkSuccess returns nil if attempt accepted as success by Config.IsSuccess, otherwise original error or
+// ErrNotSuccess.
+func (wh *Webhooks) checkSuccess(info ExecutionInfo) error {
+	if wh.config.IsSuccess(info) {
+		return nil
+	}
+	if info.Err != nil {
+		return info.Err
+	}
+	return ErrNotSuccess
+}
+
+// parseRetryAfter parses Retry-After header value in seconds or HTTP date. Returns zero for empty or invalid value.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
 }
 
 func (wh *Webhooks) openStoredRequestFile(item *QueuedWebhook) (*os.File, error) {
@@ -120,7 +457,11 @@ func (wh *Webhooks) openStoredRequestFile(item *QueuedWebhook) (*os.File, error)
 		if err == nil {
 			return tmpFile, nil
 		}
-		log.Println("attempt", i+1, "of", item.Manifest.Retries, "failed open stored request file:", err)
+		wh.config.Logger.Warn("failed open stored request file",
+			"file", item.RequestFile,
+			"attempt", i+1,
+			"attempts", item.Manifest.Retries+1,
+			"error", err)
 		if i < item.Manifest.Retries {
 			time.Sleep(item.Manifest.Delay)
 		}
@@ -145,6 +486,7 @@ func (wh *Webhooks) isAsyncRequest(mode AsyncMode, req *http.Request) bool {
 type nopWriter struct {
 	status  int
 	headers http.Header
+	output  *internal.TailBuffer // optional
 }
 
 func (nw *nopWriter) Header() http.Header {
@@ -155,6 +497,9 @@ func (nw *nopWriter) Header() http.Header {
 }
 
 func (nw *nopWriter) Write(i []byte) (int, error) {
+	if nw.output != nil {
+		return nw.output.Write(i)
+	}
 	return len(i), nil
 }
 
@@ -5,6 +5,7 @@ package wd
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/xattr"
@@ -50,6 +51,73 @@ func readAttrs(file string, manifest *Manifest) error {
 			} else {
 				manifest.Retries = uint(v)
 			}
+		case AttrMaxResponse:
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else if v, err := strconv.ParseInt(string(data), 10, 64); err != nil {
+				return fmt.Errorf("parse %s as int: %w", name, err)
+			} else {
+				manifest.MaxResponse = v
+			}
+		case AttrWorkDir:
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else {
+				manifest.WorkDir = string(data)
+			}
+		case AttrQuery:
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else {
+				manifest.Query = splitList(string(data))
+			}
+		case AttrMethods:
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else {
+				manifest.Methods = splitList(strings.ToUpper(string(data)))
+			}
+		case AttrNice:
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else if v, err := strconv.Atoi(string(data)); err != nil {
+				return fmt.Errorf("parse %s as int: %w", name, err)
+			} else {
+				manifest.Nice = v
+			}
+		case AttrIOClass:
+			var class IOClass
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else if err := class.UnmarshalText(data); err != nil {
+				return fmt.Errorf("parse %s as IO class: %w", name, err)
+			} else {
+				manifest.IOClass = class
+			}
+		case AttrCallback:
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else {
+				manifest.Callback = string(data)
+			}
+		case AttrBackoff:
+			var strategy BackoffStrategy
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else if err := strategy.UnmarshalText(data); err != nil {
+				return fmt.Errorf("parse %s as backoff: %w", name, err)
+			} else {
+				manifest.Backoff = strategy
+			}
+		case AttrRateLimit:
+			var limit RateLimit
+			if data, err := xattr.Get(file, name); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			} else if err := limit.UnmarshalText(data); err != nil {
+				return fmt.Errorf("parse %s as rate limit: %w", name, err)
+			} else {
+				manifest.RateLimit = limit
+			}
 		}
 	}
 	return nil
@@ -1,5 +1,33 @@
 package wd
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// SidecarSuffix defines suffix of optional JSON file next to the script with script specific parameters.
+// Used instead of extended attributes on Windows. For example, for script deploy.ps1 file will be deploy.ps1.wd.json:
+//
+//	{"async": "forced", "timeout": "5m", "delay": "10s", "retries": 3}
+const SidecarSuffix = ".wd.json"
+
 func readAttrs(file string, manifest *Manifest) error {
+	data, err := ioutil.ReadFile(file + SidecarSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read sidecar: %w", err)
+	}
+	var attrs routeDefinition
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return fmt.Errorf("parse sidecar: %w", err)
+	}
+	override := attrs.Manifest()
+	override.Command = nil // command is always script itself
+	manifest.Merge(override)
 	return nil
 }
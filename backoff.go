@@ -0,0 +1,123 @@
+package wd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownBackoff = errors.New("backoff strategy unknown")
+
+// BackoffKind defines how delay between async attempts changes.
+type BackoffKind byte
+
+const (
+	BackoffDefault     BackoffKind = iota // inherited, constant if not defined
+	BackoffConstant                       // the same delay between all attempts
+	BackoffExponential                    // delay multiplied for each next attempt
+)
+
+// DefaultBackoffMultiplier used for exponential backoff if multiplier not defined.
+const DefaultBackoffMultiplier = 2
+
+// BackoffStrategy computes delay between async attempts based on Manifest.Delay. Text representation is
+// comma-separated kind and options:
+//
+//	constant
+//	exponential,multiplier=2,max=5m,jitter
+type BackoffStrategy struct {
+	Kind       BackoffKind
+	Multiplier float64       // (exponential only) delay multiplier for each next attempt, DefaultBackoffMultiplier if not set
+	Max        time.Duration // (exponential only) maximum delay. Zero means unlimited
+	Jitter     bool          // (exponential only) randomize delay in range [delay/2, delay]
+}
+
+// Delay before the next attempt after failed attempt (starting from 0).
+func (bs BackoffStrategy) Delay(delay time.Duration, attempt uint) time.Duration {
+	if bs.Kind != BackoffExponential {
+		return delay
+	}
+	multiplier := bs.Multiplier
+	if multiplier <= 0 {
+		multiplier = DefaultBackoffMultiplier
+	}
+	value := float64(delay) * math.Pow(multiplier, float64(attempt))
+	if bs.Max > 0 && value > float64(bs.Max) {
+		value = float64(bs.Max)
+	}
+	if value > math.MaxInt64 {
+		value = math.MaxInt64
+	}
+	delay = time.Duration(value)
+	if bs.Jitter && delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
+
+func (bs *BackoffStrategy) UnmarshalText(data []byte) error {
+	parts := strings.Split(string(data), ",")
+	var strategy BackoffStrategy
+	switch strings.TrimSpace(parts[0]) {
+	case "":
+		strategy.Kind = BackoffDefault
+	case "constant":
+		strategy.Kind = BackoffConstant
+	case "exponential":
+		strategy.Kind = BackoffExponential
+	default:
+		return ErrUnknownBackoff
+	}
+	for _, option := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		switch name {
+		case "multiplier":
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("parse multiplier: %w", err)
+			}
+			strategy.Multiplier = v
+		case "max":
+			v, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("parse max: %w", err)
+			}
+			strategy.Max = v
+		case "jitter":
+			strategy.Jitter = true
+		default:
+			return fmt.Errorf("unknown backoff option %q", name)
+		}
+	}
+	*bs = strategy
+	return nil
+}
+
+func (bs BackoffStrategy) MarshalText() ([]byte, error) {
+	return []byte(bs.String()), nil
+}
+
+func (bs BackoffStrategy) String() string {
+	switch bs.Kind {
+	case BackoffConstant:
+		return "constant"
+	case BackoffExponential:
+		value := "exponential"
+		if bs.Multiplier > 0 {
+			value += ",multiplier=" + strconv.FormatFloat(bs.Multiplier, 'g', -1, 64)
+		}
+		if bs.Max > 0 {
+			value += ",max=" + bs.Max.String()
+		}
+		if bs.Jitter {
+			value += ",jitter"
+		}
+		return value
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,36 @@
+package wd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/reddec/wd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffStrategy_Delay(t *testing.T) {
+	var strategy wd.BackoffStrategy
+	require.NoError(t, strategy.UnmarshalText([]byte("exponential,multiplier=2,max=5s")))
+
+	var delays []time.Duration
+	for attempt := uint(0); attempt < 4; attempt++ {
+		delays = append(delays, strategy.Delay(time.Second, attempt))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, delays)
+	assert.Equal(t, "exponential,multiplier=2,max=5s", strategy.String())
+
+	// constant is default
+	assert.Equal(t, time.Second, wd.BackoffStrategy{}.Delay(time.Second, 3))
+	assert.Equal(t, time.Second, wd.BackoffStrategy{Kind: wd.BackoffConstant}.Delay(time.Second, 3))
+
+	jitter := wd.BackoffStrategy{Kind: wd.BackoffExponential, Jitter: true}
+	for i := 0; i < 10; i++ {
+		delay := jitter.Delay(time.Second, 2)
+		assert.GreaterOrEqual(t, delay, 2*time.Second)
+		assert.LessOrEqual(t, delay, 4*time.Second)
+	}
+
+	assert.ErrorIs(t, strategy.UnmarshalText([]byte("linear")), wd.ErrUnknownBackoff)
+	assert.Error(t, strategy.UnmarshalText([]byte("exponential,max=soon")))
+}
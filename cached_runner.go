@@ -0,0 +1,141 @@
+package wd
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// CachedDirectoryRunner wraps DirectoryRunner and caches found scripts and their manifests (xattrs) in memory to
+// avoid file system calls on each request. Cache is completely invalidated on any file system event (create, write,
+// remove, rename, attributes change) in scripts directory (including sub-directories).
+//
+// Only existent scripts are cached, so cache miss falls through to DirectoryRunner.
+type CachedDirectoryRunner struct {
+	runner     *DirectoryRunner
+	watcher    *fsnotify.Watcher
+	lock       sync.RWMutex
+	generation uint64 // incremented on each invalidation
+	cache      map[string]cachedManifest
+	done       chan struct{}
+}
+
+type cachedManifest struct {
+	base     Manifest // default manifest used to build manifest
+	manifest Manifest
+}
+
+// NewCachedDirectoryRunner starts watching scripts directory of runner. Close should be called to release resources.
+func NewCachedDirectoryRunner(runner *DirectoryRunner) (*CachedDirectoryRunner, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %w", err)
+	}
+	cr := &CachedDirectoryRunner{
+		runner:  runner,
+		watcher: watcher,
+		cache:   make(map[string]cachedManifest),
+		done:    make(chan struct{}),
+	}
+	if err := cr.watch(runner.ScriptsDir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go cr.listen()
+	return cr, nil
+}
+
+func (cr *CachedDirectoryRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	key := filepath.Join(cr.runner.ScriptsDir, req.URL.Path)
+
+	cr.lock.RLock()
+	entry, ok := cr.cache[key]
+	generation := cr.generation
+	cr.lock.RUnlock()
+
+	if ok && reflect.DeepEqual(entry.base, defaultManifest) {
+		manifest := entry.manifest
+		return &manifest
+	}
+
+	manifest := cr.runner.Command(req, defaultManifest)
+	if manifest == nil {
+		return nil
+	}
+	if _, err := os.Stat(manifest.Binary()); err != nil {
+		// do not cache non-existent scripts
+		return manifest
+	}
+
+	cr.lock.Lock()
+	if cr.generation == generation {
+		// cache only if nothing changed during lookup
+		cr.cache[key] = cachedManifest{base: defaultManifest, manifest: *manifest}
+	}
+	cr.lock.Unlock()
+	return manifest
+}
+
+// Close stops watching scripts directory.
+func (cr *CachedDirectoryRunner) Close() error {
+	err := cr.watcher.Close()
+	<-cr.done
+	return err
+}
+
+func (cr *CachedDirectoryRunner) invalidate() {
+	cr.lock.Lock()
+	cr.generation++
+	cr.cache = make(map[string]cachedManifest)
+	cr.lock.Unlock()
+}
+
+func (cr *CachedDirectoryRunner) listen() {
+	defer close(cr.done)
+	for {
+		select {
+		case event, ok := <-cr.watcher.Events:
+			if !ok {
+				return
+			}
+			cr.invalidate()
+			if event.Op&fsnotify.Create == 0 {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				if err := cr.watch(event.Name); err != nil {
+					slog.Error("failed watch new directory", "dir", event.Name, "error", err)
+				}
+			}
+		case err, ok := <-cr.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may be lost
+			cr.invalidate()
+			slog.Error("failed watch scripts directory", "dir", cr.runner.ScriptsDir, "error", err)
+		}
+	}
+}
+
+// watch directory and all sub-directories.
+func (cr *CachedDirectoryRunner) watch(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := cr.watcher.Add(path); err != nil {
+			return fmt.Errorf("watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,79 @@
+package wd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	callbackAttempts = 3                // maximum number of attempts to deliver completion callback
+	callbackTimeout  = 10 * time.Second // timeout of single attempt to deliver completion callback
+	callbackDelay    = time.Second      // delay between attempts to deliver completion callback
+)
+
+// completeTask sets final state of async request and notifies completion callback (see Config.CompletionCallback).
+func (wh *Webhooks) completeTask(ctx context.Context, item *QueuedWebhook, state TaskState, attempts uint, taskErr error) {
+	wh.setTaskState(ctx, item, state, attempts, taskErr)
+	if item.Manifest == nil || item.Manifest.Callback == "" {
+		return
+	}
+	status := TaskStatus{
+		ID:       item.TaskID,
+		Path:     item.Path,
+		State:    state,
+		Attempts: attempts,
+		Updated:  time.Now(),
+	}
+	if taskErr != nil {
+		status.Error = taskErr.Error()
+	}
+	if err := wh.notifyCallback(ctx, item.Manifest.Callback, status); err != nil {
+		wh.config.Logger.Warn("failed deliver completion callback", "path", item.Path, "callback", item.Manifest.Callback, "error", err)
+	}
+}
+
+// notifyCallback posts status as JSON to callback URL. Delivery retried limited number of times.
+func (wh *Webhooks) notifyCallback(ctx context.Context, callback string, status TaskStatus) error {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("encode status: %w", err)
+	}
+	for i := 0; i < callbackAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(callbackDelay):
+			}
+		}
+		err = postCallback(ctx, callback, payload)
+		if err == nil {
+			return nil
+		}
+		wh.config.Logger.Debug("completion callback attempt failed", "path", status.Path, "attempt", i+1, "error", err)
+	}
+	return err
+}
+
+func postCallback(ctx context.Context, callback string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
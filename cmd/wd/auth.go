@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/reddec/wd"
+)
+
+// keyFuncs resolve keys for token verification. Token is valid if it's valid by any of them.
+type keyFuncs []jwt.Keyfunc
+
+// keyFunc returns functions to resolve key for token verification. If public key defined, only asymmetric
+// (RSA or ECDSA) tokens are accepted, otherwise only HMAC signed tokens by any of shared secrets. Returns nil if
+// tokens are not used.
+func (cfg Config) keyFunc() (keyFuncs, error) {
+	if cfg.JWTPublicKey == "" && len(cfg.Secrets) == 0 {
+		return nil, nil
+	}
+	if cfg.JWTPublicKey == "" {
+		var funcs = make(keyFuncs, 0, len(cfg.Secrets))
+		for _, secret := range cfg.signSecrets() {
+			secret := secret
+			funcs = append(funcs, func(token *jwt.Token) (interface{}, error) {
+				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+				}
+				return secret, nil
+			})
+		}
+		return funcs, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.JWTPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return keyFuncs{func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key, nil
+		}}, nil
+	}
+
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return keyFuncs{func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key, nil
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("public key %s is neither RSA nor ECDSA PEM", cfg.JWTPublicKey)
+}
+
+// basicUsers parses user:password pairs for basic authorization.
+func (cfg Config) basicUsers() (map[string]string, error) {
+	var users = make(map[string]string, len(cfg.BasicAuth))
+	for _, pair := range cfg.BasicAuth {
+		idx := strings.Index(pair, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("basic auth should be in user:password format")
+		}
+		users[pair[:idx]] = pair[idx+1:]
+	}
+	return users, nil
+}
+
+// signSecrets returns secrets for signed URLs or nil if signed URLs are not used. The first secret is used for
+// signing.
+func (cfg Config) signSecrets() [][]byte {
+	var secrets [][]byte
+	for _, secret := range cfg.Secrets {
+		secrets = append(secrets, []byte(secret))
+	}
+	return secrets
+}
+
+// isProtected returns true if tokens or basic authorization are required.
+func (cfg Config) isProtected() bool {
+	return len(cfg.Secrets) > 0 || cfg.JWTPublicKey != "" || len(cfg.BasicAuth) > 0
+}
+
+var forbiddenNum = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "webhooks",
+	Name:      "forbidden",
+	Help:      "total number of rejected unauthorized requests",
+})
+
+func recordForbidden(writer http.ResponseWriter) {
+	forbiddenNum.Inc()
+	writer.WriteHeader(http.StatusForbidden)
+}
+
+// checkBasic returns true if request has valid basic authorization.
+func checkBasic(users map[string]string, request *http.Request) (string, bool) {
+	user, password, ok := request.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, exists := users[user]
+	if !exists {
+		// constant time regardless of user existence
+		expected = password + "-"
+	}
+	return user, subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && exists
+}
+
+// parseToken parses and validates JWT from Authorization header or token query param.
+func parseToken(keyFunc keyFuncs, request *http.Request) (jwt.MapClaims, bool) {
+	if keyFunc == nil {
+		return nil, false
+	}
+
+	tokenString := request.Header.Get("Authorization")
+	if tokenString == "" {
+		tokenString = request.URL.Query().Get("token")
+	}
+	claims, err := verifyToken(keyFunc, tokenString)
+	return claims, err == nil
+}
+
+// verifyToken parses and validates JWT (optionally prefixed by scheme, ex: Bearer) and returns claims. Token is
+// checked by each key function till the first success. Returns error of the last key function if none succeeded.
+func verifyToken(keyFunc keyFuncs, tokenString string) (jwt.MapClaims, error) {
+	var err = errors.New("no keys to verify token")
+	for _, fn := range keyFunc {
+		var claims jwt.MapClaims
+		claims, err = verifyTokenByKey(fn, tokenString)
+		if err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
+
+func verifyTokenByKey(keyFunc jwt.Keyfunc, tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(lastPart(tokenString), keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// lastPart returns token without scheme (ex: Bearer).
+func lastPart(tokenString string) string {
+	parts := strings.Split(tokenString, " ")
+	return parts[len(parts)-1]
+}
+
+// allowedHooks returns hooks from token audience. Empty means all hooks allowed.
+func allowedHooks(claims jwt.MapClaims) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var hooks = make([]string, 0, len(aud))
+		for _, v := range aud {
+			if hook, ok := v.(string); ok {
+				hooks = append(hooks, hook)
+			}
+		}
+		return hooks
+	}
+	return nil
+}
+
+// isHookAllowed checks that hook (request path) is allowed by token audience.
+func isHookAllowed(claims jwt.MapClaims, path string) bool {
+	hooks := allowedHooks(claims)
+	if len(hooks) == 0 {
+		return true
+	}
+	requestedAud := strings.Trim(path, "/")
+	for _, hook := range hooks {
+		if hook == requestedAud {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted allows only requests with valid JWT which explicitly contains action in audience. Basic authorization
+// is not accepted.
+func restricted(keyFunc keyFuncs, action string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		claims, ok := parseToken(keyFunc, request)
+		if !ok || !claims.VerifyAudience(action, true) {
+			recordForbidden(writer)
+			return
+		}
+		if sub, ok := claims["sub"].(string); ok {
+			slog.Info("authorized request", "path", request.URL.Path, "subject", sub)
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// withDebug routes debug requests (with wd.DebugHeader) to debug handler and all others to next handler.
+func withDebug(debug http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get(wd.DebugHeader) != "" {
+			debug.ServeHTTP(writer, request)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// protected allows requests with valid JWT (if keyFunc defined), valid basic authorization (if users defined) or
+// valid signed URL (if secrets defined).
+func protected(keyFunc keyFuncs, users map[string]string, secrets [][]byte, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// subject is defined only by authorization
+		request.Header.Del("X-Subject")
+		if _, _, isBasic := request.BasicAuth(); isBasic && len(users) > 0 {
+			user, ok := checkBasic(users, request)
+			if !ok {
+				recordForbidden(writer)
+				return
+			}
+			slog.Info("authorized request", "path", request.URL.Path, "subject", user)
+			request.Header.Set("X-Subject", user)
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		if request.URL.Query().Has("sig") && len(secrets) > 0 {
+			if !checkSignature(secrets, request) {
+				recordForbidden(writer)
+				return
+			}
+			slog.Info("authorized request by signed URL", "path", request.URL.Path)
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		claims, ok := parseToken(keyFunc, request)
+		if !ok {
+			recordForbidden(writer)
+			return
+		}
+
+		if !isHookAllowed(claims, request.URL.Path) {
+			recordForbidden(writer)
+			return
+		}
+
+		if sub, ok := claims["sub"].(string); ok {
+			slog.Info("authorized request", "path", request.URL.Path, "subject", sub)
+			request.Header.Set("X-Subject", sub)
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtected_audience(t *testing.T) {
+	cfg := Config{Secrets: []string{"secret"}}
+	keyFunc, err := cfg.keyFunc()
+	require.NoError(t, err)
+	handler := protected(keyFunc, nil, nil, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(aud interface{}, path string) int {
+		claims := jwt.MapClaims{"sub": "alice"}
+		if aud != nil {
+			claims["aud"] = aud
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.Secrets[0]))
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(nil, "/deploy"), "no audience - all hooks")
+
+	assert.Equal(t, http.StatusOK, send("deploy", "/deploy"))
+	assert.Equal(t, http.StatusForbidden, send("deploy", "/other"))
+
+	assert.Equal(t, http.StatusOK, send([]string{"deploy", "backup"}, "/backup"))
+	assert.Equal(t, http.StatusForbidden, send([]string{"deploy", "backup"}, "/other"))
+}
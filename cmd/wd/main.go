@@ -2,23 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/reddec/wd"
 	"github.com/rs/cors"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -30,45 +42,135 @@ var (
 )
 
 type Config struct {
-	Serve CmdServe `command:"serve" description:"serve server from directory"`
-	Run   CmdRun   `command:"run" description:"run single script"`
-	Token CmdToken `command:"token" description:"issue token"`
-
-	CORS           bool          `long:"cors" env:"CORS" description:"Enable CORS"`
-	Bind           string        `short:"b" long:"bind" env:"BIND" description:"Binding address" default:"127.0.0.1:8080"`
-	Timeout        time.Duration `short:"t" long:"timeout" env:"TIMEOUT" description:"Maximum execution timeout" default:"120s"`
-	Secret         string        `short:"s" long:"secret" env:"SECRET" description:"JWT secret for checking tokens. Use token command to create token"`
-	Buffer         int           `short:"B" long:"buffer" env:"BUFFER" description:"Buffer response size" default:"8192"`
-	Async          string        `short:"a" long:"async" env:"ASYNC" description:"Async mode. auto - relies on async param in query, forced - always async, disabled - no async" default:"auto" choice:"auto" choice:"forced" choice:"disabled"`
-	Retries        uint          `short:"r" long:"retries" env:"RETRIES" description:"Number of additional retries after first attempt (async only)" default:"3"`
-	Delay          time.Duration `short:"d" long:"delay" env:"DELAY" description:"Delay between attempts (async only)" default:"3s"`
-	Workers        int64         `short:"W" long:"workers" env:"WORKERS" description:"Maximum number of workers for sync requests. Default is 2 x num CPU"`
-	AsyncWorkers   int           `short:"A" long:"async-workers" env:"ASYNC_WORKERS" description:"Number of workers to process async requests" default:"2"`
-	Queue          int           `short:"q" long:"queue" env:"QUEUE" description:"Queue size for async requests. 0 means unbound" default:"8192"`
-	Payload        string        `short:"p" long:"payload" env:"PAYLOAD" description:"Payload type - how to pass request body to the script" default:"stdin" choice:"stdin" choice:"arg" choice:"env"`
-	PayloadSize    int64         `short:"P" long:"payload-size" env:"PAYLOAD_SIZE" description:"Maximum payload size in bytes. Zero or negative means unlimited" default:"10485760"` // default - 10MB
-	DisableMetrics bool          `short:"M" long:"disable-metrics" env:"DISABLE_METRICS" description:"Disable prometheus metrics"`
-	SecureMetrics  bool          `long:"secure-metrics" env:"SECURE_METRICS" description:"Require token to access metrics endpoint"`
+	Serve  CmdServe  `command:"serve" description:"serve server from directory"`
+	Run    CmdRun    `command:"run" description:"run single script"`
+	Token  CmdToken  `command:"token" description:"issue token"`
+	Sign   CmdSign   `command:"sign" description:"issue signed URL"`
+	Verify CmdVerify `command:"verify" description:"verify token and show claims"`
+
+	CORS            bool             `long:"cors" env:"CORS" description:"Enable CORS"`
+	Bind            string           `short:"b" long:"bind" env:"BIND" description:"Binding address" default:"127.0.0.1:8080"`
+	Systemd         bool             `long:"systemd" env:"SYSTEMD" description:"Use socket passed by systemd socket activation instead of binding. Falls back to --bind if not socket-activated"`
+	Timeout         time.Duration    `short:"t" long:"timeout" env:"TIMEOUT" description:"Maximum execution timeout" default:"120s"`
+	RequestDeadline time.Duration    `long:"max-request-duration" env:"MAX_REQUEST_DURATION" description:"Maximum total duration of request handling including waiting for workers and I/O. Zero means unlimited"`
+	Secrets         []string         `short:"s" long:"secret" env:"SECRET" env-delim:"," description:"JWT secret for checking tokens. Can be repeated for rotation: any of secrets is accepted, the first one is used to issue tokens. Use token command to create token"`
+	BasicAuth       []string         `long:"basic-auth" env:"BASIC_AUTH" env-delim:"," description:"Allowed user:password for basic authorization. Can be used together with tokens"`
+	JWTPublicKey    string           `long:"jwt-public-key" env:"JWT_PUBLIC_KEY" description:"Path to PEM encoded RSA or ECDSA public key for checking tokens. Disables --secret for checking tokens"`
+	Buffer          int              `short:"B" long:"buffer" env:"BUFFER" description:"Buffer response size" default:"8192"`
+	MaxBuffer       int              `long:"max-buffer" env:"MAX_BUFFER" description:"Maximum buffer response size which can be requested by client (query param buffer). Can not be less than --buffer"`
+	BufferMemory    int64            `long:"buffer-memory" env:"BUFFER_MEMORY" description:"Total memory in bytes for buffers of all concurrent responses. If exhausted, responses are not buffered. Zero means unlimited"`
+	MaxResponse     int64            `long:"max-response" env:"MAX_RESPONSE" description:"Maximum size of script output in bytes. Once exceeded, script will be terminated and response truncated. Zero means unlimited"`
+	FlushInterval   time.Duration    `long:"flush-interval" env:"FLUSH_INTERVAL" description:"Interval to send partial output of slow scripts to client. Zero means no periodic flushes"`
+	Async           string           `short:"a" long:"async" env:"ASYNC" description:"Async mode. auto - relies on async param in query, forced - always async, disabled - no async" default:"auto" choice:"auto" choice:"forced" choice:"disabled"`
+	Retries         uint             `short:"r" long:"retries" env:"RETRIES" description:"Number of additional retries after first attempt (async only)" default:"3"`
+	Delay           time.Duration    `short:"d" long:"delay" env:"DELAY" description:"Delay between attempts (async only)" default:"3s"`
+	Callback        string           `long:"callback" env:"CALLBACK" description:"URL which receives POST with JSON status once async request is finished (succeeded or failed after all attempts)"`
+	Backoff         string           `long:"backoff" env:"BACKOFF" description:"Delay between attempts strategy (async only): constant or exponential with options (ex: exponential,multiplier=2,max=5m,jitter)" default:"constant"`
+	NoRetryExitCode int              `long:"no-retry-exit-code" env:"NO_RETRY_EXIT_CODE" description:"Exit code of script which stops retries (async only). Zero means retry on any non-zero exit code"`
+	MaxRetryAfter   time.Duration    `long:"max-retry-after" env:"MAX_RETRY_AFTER" description:"Maximum delay before the next attempt requested by failed script in Retry-After header (requires --script-headers) or by --backoff-exit-code (async only). Zero means requests ignored"`
+	BackoffExitCode int              `long:"backoff-exit-code" env:"BACKOFF_EXIT_CODE" description:"Exit code of script which requests maximum delay (--max-retry-after) before the next attempt (async only). Zero means not used"`
+	RateLimit       string           `long:"rate-limit" env:"RATE_LIMIT" description:"Default maximum rate of requests per script as requests/period (ex: 10/1m), rejected with 429 once exceeded. Can be overridden by xattr user.webhook.ratelimit. Empty means unlimited"`
+	RateLimitBy     string           `long:"rate-limit-by" env:"RATE_LIMIT_BY" description:"Additional key of rate limit: none - shared by all clients, subject - authenticated subject, ip - client IP" default:"none" choice:"none" choice:"subject" choice:"ip"`
+	RetryBudget     float64          `long:"retry-budget" env:"RETRY_BUDGET" description:"Maximum ratio of retries to successful requests per path (ex: 0.1), retries are skipped once exhausted (async only). Zero means unlimited"`
+	AsyncLifetime   time.Duration    `long:"max-async-lifetime" env:"MAX_ASYNC_LIFETIME" description:"Maximum time of async request processing since enqueue, including time in queue and all attempts. Remaining attempts are abandoned once exceeded. Zero means unlimited"`
+	Nice            int              `long:"nice" env:"NICE" description:"Niceness of scripts (Linux only). Negative values require privileges. Zero means inherited"`
+	IOClass         string           `long:"io-class" env:"IO_CLASS" description:"IO scheduling class of scripts (Linux only). Real-time requires privileges" default:"default" choice:"default" choice:"realtime" choice:"best-effort" choice:"idle"`
+	AsyncNice       int              `long:"async-nice" env:"ASYNC_NICE" description:"Niceness increment for async executions (Linux only)"`
+	Workers         int64            `short:"W" long:"workers" env:"WORKERS" description:"Maximum number of workers for sync requests. Default is 2 x num CPU"`
+	PathWorkers     int64            `long:"path-workers" env:"PATH_WORKERS" description:"Maximum number of parallel sync requests per path. Zero means no per-path limit"`
+	MaxSpooling     int64            `long:"max-spooling" env:"MAX_SPOOLING" description:"Maximum number of async requests simultaneously stored to queue dir. Others wait. Zero means unlimited"`
+	MaxConcurrent   int64            `long:"max-concurrent" env:"MAX_CONCURRENT" description:"Maximum number of simultaneously running scripts across sync and async requests. Zero means unlimited"`
+	PathLimits      map[string]int64 `long:"path-limit" env:"PATH_LIMIT" env-delim:"," description:"Maximum number of parallel sync requests for specific path (ex: /report:1). Overrides --path-workers"`
+	AsyncWorkers    int              `short:"A" long:"async-workers" env:"ASYNC_WORKERS" description:"Number of workers to process async requests" default:"2"`
+	Queue           int              `short:"q" long:"queue" env:"QUEUE" description:"Queue size for async requests. 0 means unbound" default:"8192"`
+	Idempotency     bool             `long:"idempotency" env:"IDEMPOTENCY" description:"Do not execute duplicated requests with the same Idempotency-Key header and path, status of the first request is returned instead"`
+	IdempotencyTTL  time.Duration    `long:"idempotency-ttl" env:"IDEMPOTENCY_TTL" description:"Time to remember idempotency keys" default:"24h"`
+	SpillDir        string           `long:"spill-dir" env:"SPILL_DIR" description:"Directory to spill queued async requests once --queue is full instead of blocking clients. Disabled if not set"`
+	SpillSize       int64            `long:"spill-size" env:"SPILL_SIZE" description:"Maximum total size in bytes of spilled queue items (--spill-dir). Clients are blocked once exceeded. Zero means unlimited"`
+	QueueDir        string           `long:"queue-dir" env:"QUEUE_DIR" description:"Directory for serialized async requests. Must be shared between instances in case of Redis queue. Default is system temp dir"`
+	RedisURL        string           `long:"redis-url" env:"REDIS_URL" description:"Redis URL (ex: redis://localhost:6379/0) for shared async queue. Disables --queue"`
+	RedisKey        string           `long:"redis-key" env:"REDIS_KEY" description:"Redis key for shared async queue" default:"wd:queue"`
+	DiscardPartial  bool             `long:"discard-partial" env:"DISCARD_PARTIAL" description:"Discard buffered output of failed scripts instead of sending it with error status"`
+	ExecPath        string           `long:"exec-path" env:"EXEC_PATH" description:"Search path (like PATH) for non-absolute commands. Also passed to scripts as PATH. Empty means inherited PATH"`
+	MultiValue      string           `long:"multi-value" env:"MULTI_VALUE" description:"How to pass repeated query params and headers. join - comma-separated, indexed - additionally each value with index suffix (QUERY_TAG_0)" default:"join" choice:"join" choice:"indexed"`
+	TrustForwarded  bool             `long:"trust-forwarded" env:"TRUST_FORWARDED" description:"Use X-Forwarded-Proto, X-Forwarded-Host and X-Real-IP from trusted proxies for REQUEST_SCHEME, REQUEST_HOST and CLIENT_IP"`
+	TrustedProxies  []string         `long:"trusted-proxy" env:"TRUSTED_PROXY" env-delim:"," description:"CIDR of trusted reverse proxy (ex: 10.0.0.0/8). X-Forwarded-For from trusted proxies is used for CLIENT_IP"`
+	StrictQuery     bool             `long:"strict-query" env:"STRICT_QUERY" description:"Reject requests with query params not in --allowed-query or in script specific list (xattr user.webhook.query)"`
+	AllowedQuery    []string         `long:"allowed-query" env:"ALLOWED_QUERY" env-delim:"," description:"Query params allowed for all scripts in strict query mode"`
+	HeaderPrefix    string           `long:"header-prefix" env:"HEADER_PREFIX" description:"Prefix of environment variables for request headers" default:"HEADER_"`
+	QueryPrefix     string           `long:"query-prefix" env:"QUERY_PREFIX" description:"Prefix of environment variables for query params" default:"QUERY_"`
+	HeaderPattern   string           `long:"headers-env-pattern" env:"HEADERS_ENV_PATTERN" description:"Pass as environment variables only headers with canonical name (ex: X-Github-Event) matched by regular expression (ex: (?i)^X-GitHub-)"`
+	NoHeadersEnv    bool             `long:"no-headers-env" env:"NO_HEADERS_ENV" description:"Do not pass request headers as environment variables"`
+	NoQueryEnv      bool             `long:"no-query-env" env:"NO_QUERY_ENV" description:"Do not pass query params as environment variables"`
+	Payload         string           `short:"p" long:"payload" env:"PAYLOAD" description:"Payload type - how to pass request body to the script" default:"stdin" choice:"stdin" choice:"arg" choice:"env" choice:"file"`
+	BinaryPayload   string           `long:"binary-payload" env:"BINARY_PAYLOAD" description:"How to pass payload with NUL bytes in arg or env payload types: reject - 400 Bad Request, base64 - encode and set REQUEST_BODY_ENCODING=base64" default:"reject" choice:"reject" choice:"base64"`
+	RequireBody     []string         `long:"require-body" env:"REQUIRE_BODY" env-delim:"," description:"Reject requests without body to path (ex: /deploy or /user/:id) with 400 (411 without Content-Length). Can be repeated"`
+	SkipBodyless    bool             `long:"skip-bodyless-payload" env:"SKIP_BODYLESS_PAYLOAD" description:"Do not pass payload for GET, HEAD, DELETE, OPTIONS and TRACE requests in arg or env payload types"`
+	SubjectLimit    int64            `long:"subject-concurrency" env:"SUBJECT_CONCURRENCY" description:"Maximum number of in-flight requests per authenticated subject (429 once exceeded). Requests without subject share the same limit. Zero means unlimited"`
+	MaxCachedBody   int64            `long:"max-cached-body" env:"MAX_CACHED_BODY" description:"Maximum payload size in bytes for env and arg payload types which keep payload in memory. Zero means limited only by --payload-size"`
+	PayloadSize     int64            `short:"P" long:"payload-size" env:"PAYLOAD_SIZE" description:"Maximum payload size in bytes. Zero or negative means unlimited" default:"10485760"` // default - 10MB
+	DisableMetrics  bool             `short:"M" long:"disable-metrics" env:"DISABLE_METRICS" description:"Disable prometheus metrics"`
+	PayloadBuckets  []float64        `long:"payload-buckets" env:"PAYLOAD_BUCKETS" env-delim:"," description:"Histogram buckets for payload size in bytes"`
+	ResponseBuckets []float64        `long:"response-buckets" env:"RESPONSE_BUCKETS" env-delim:"," description:"Histogram buckets for response size in bytes"`
+	TimingBuckets   []float64        `long:"timing-buckets" env:"TIMING_BUCKETS" env-delim:"," description:"Histogram buckets for processing time in seconds"`
+	ShutdownAPI     bool             `long:"shutdown-endpoint" env:"SHUTDOWN_ENDPOINT" description:"Enable POST /_admin/shutdown for graceful shutdown. Requires token issued for shutdown action"`
+	ErrorsAPI       bool             `long:"errors-endpoint" env:"ERRORS_ENDPOINT" description:"Enable GET /_admin/errors with last error per path in JSON. Requires token issued for debug action"`
+	RedactErrors    bool             `long:"redact-errors" env:"REDACT_ERRORS" description:"Expose only class of errors (exit status, timeout) in /_admin/errors instead of full messages"`
+	DebugRequests   bool             `long:"debug-requests" env:"DEBUG_REQUESTS" description:"Requests with X-WD-Debug header return resolved command in JSON instead of execution. Requires token issued for debug action"`
+	TasksAPI        bool             `long:"tasks" env:"TASKS" description:"Track async requests: task ID returned in X-Task-Id header and body, status available by GET {tasks-path}{id} (also in Location header)"`
+	TasksPath       string           `long:"tasks-path" env:"TASKS_PATH" description:"Path prefix of task status endpoint" default:"/_tasks/"`
+	DisableHealth   bool             `long:"disable-health" env:"DISABLE_HEALTH" description:"Disable health (/healthz) and readiness (/readyz) endpoints"`
+	ShutdownTimeout time.Duration    `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" description:"Maximum time to wait for in-flight requests and queued async tasks during shutdown" default:"30s"`
+	SecureMetrics   bool             `long:"secure-metrics" env:"SECURE_METRICS" description:"Require token to access metrics endpoint"`
+	MetricsPaths    []string         `long:"metrics-path" env:"METRICS_PATH" env-delim:"," description:"Path pattern for metrics labels to limit cardinality (ex: /user/:id). Segments with leading colon match any value"`
+	Exemplars       bool             `long:"exemplars" env:"EXEMPLARS" description:"Attach trace ID from W3C traceparent header as exemplar to histograms. Enables OpenMetrics format for metrics endpoint"`
+	ManifestSecrets []string         `long:"manifest-secret" env:"MANIFEST_SECRETS" env-delim:"," description:"Secret for verifying signature of X-WD-Manifest header with per-request manifest override (timeout, retries, delay, async). Can be repeated. Header ignored if not set"`
+	HMACSecret      string           `long:"hmac-secret" env:"HMAC_SECRET" description:"Secret for verifying HMAC-SHA256 signature of request body (GitHub-style)"`
+	HMACHeader      string           `long:"hmac-header" env:"HMAC_HEADER" description:"Header with HMAC signature" default:"X-Hub-Signature-256"`
+	ScriptHeaders   bool             `short:"H" long:"script-headers" env:"SCRIPT_HEADERS" description:"Parse headers block (terminated by blank line) from script output. Pseudo-header Status sets response code"`
+	LogFormat       string           `long:"log-format" env:"LOG_FORMAT" description:"Logs format" default:"text" choice:"text" choice:"json"`
 	// TLS
 	AutoTLS         []string `long:"auto-tls" env:"AUTO_TLS" description:"Automatic TLS (Let's Encrypt) for specified domains. Service must be accessible by 80/443 port. Disables --tls"`
 	AutoTLSCacheDir string   `long:"auto-tls-cache-dir" env:"AUTO_TLS_CACHE_DIR" description:"Location where to store certificates" default:".certs"`
 	TLS             bool     `long:"tls" env:"TLS" description:"Enable HTTPS serving with TLS. Ignored with --auto-tls'"`
 	TLSCert         string   `long:"tls-cert" env:"TLS_CERT" description:"Path to TLS certificate" default:"server.crt"`
 	TLSKey          string   `long:"tls-key" env:"TLS_KEY" description:"Path to TLS key" default:"server.key"`
+	MTLSCA          string   `long:"mtls-ca" env:"MTLS_CA" description:"Path to PEM encoded CA bundle for verifying client certificates (mutual TLS). Requires --tls or --auto-tls"`
+	MTLSOnly        bool     `long:"mtls-only" env:"MTLS_ONLY" description:"Verified client certificate is enough to call hooks: tokens, basic auth and signed URLs are not checked"`
+	MTLSPEM         bool     `long:"mtls-pem" env:"MTLS_PEM" description:"Pass verified client certificate (PEM encoded) to scripts as CLIENT_CERT_PEM"`
 }
 
 type CmdServe struct {
 	RunAsScriptOwner bool   `short:"R" long:"run-as-script-owner" env:"RUN_AS_SCRIPT_OWNER" description:"Run scripts from the same Gid/Uid as file. If isolation enabled, temp dir will be also chown. Requires root"`
+	RunAsUser        string `long:"run-as-user" env:"RUN_AS_USER" description:"Run scripts as user (name or uid) regardless of file owner. If isolation enabled, temp dir will be also chown. Requires root. Conflicts with --run-as-script-owner"`
+	RunAsGroup       string `long:"run-as-group" env:"RUN_AS_GROUP" description:"Run scripts as group (name or gid). Default is primary group of --run-as-user"`
+	NoSupplementary  bool   `long:"no-supplementary-groups" env:"NO_SUPPLEMENTARY_GROUPS" description:"Run scripts only with primary group for --run-as-script-owner and --run-as-user, without supplementary groups of the user"`
 	WorkDir          string `short:"w" long:"work-dir" env:"WORK_DIR" description:"Working directory"`
 	DisableIsolation bool   `short:"I" long:"disable-isolation" env:"DISABLE_ISOLATION" description:"Disable isolated work dirs"`
 	EnableDotFiles   bool   `short:"D" long:"enable-dot-files" env:"ENABLE_DOT_FILES" description:"Enable lookup for scripts in dor directories and files"`
+	Check            bool   `long:"check" env:"CHECK" description:"Validate scripts in directory (executable, valid xattrs) and exit without serving"`
+	Watch            bool   `long:"watch" env:"WATCH" description:"Cache scripts and xattrs in memory, invalidate cache by file system events in scripts directory"`
+	Routes           string `long:"routes" env:"ROUTES" description:"YAML or JSON file with routes: path -> command and options. Takes precedence over scripts directory. Reloaded on SIGHUP"`
+	MaxTempDirs      int64  `long:"max-temp-dirs" env:"MAX_TEMP_DIRS" description:"Maximum number of active isolated work dirs. Zero means unlimited"`
+	IndexFile        string `long:"index" env:"INDEX" description:"Script name (ex: index.sh) to run for requests to directories. Empty means directories are not served"`
+	MinFreeSpace     uint64 `long:"min-free-space" env:"MIN_FREE_SPACE" description:"Minimal free space in bytes required to create isolated work dir. Zero means no check"`
 	Args             struct {
-		Scripts string `positional-arg:"scripts-dir" required:"true" env:"SCRIPTS" description:"Scripts directory"`
+		Scripts string `positional-arg:"scripts-dir" env:"SCRIPTS" description:"Scripts directory. Optional if routes defined"`
 	} `positional-args:"yes"`
+
+	Hosts    []string `long:"host" env:"HOSTS" env-delim:"," description:"Scripts directory for virtual host in host=dir format (ex: a.example.com=/srv/a). Can be repeated. Other hosts are served by scripts directory and routes"`
+	Validate bool     `long:"validate" env:"VALIDATE" description:"Validate scripts in directories (executable, shebang, valid xattrs) on startup and log found problems"`
+	Strict   bool     `long:"strict" env:"STRICT" description:"Fail startup if problems found in scripts. Implies --validate"`
+	Header   string   `long:"route-header" env:"ROUTE_HEADER" description:"Append value of request header as the last path segment before lookup in scripts directories (ex: X-GitHub-Event routes /github to /github/push). Requests without the header are served as usual"`
+	OpenAPI  bool     `long:"openapi" env:"OPENAPI" description:"Expose OpenAPI description of scripts in scripts directory (paths, methods, async mode, query params) as /_openapi.json"`
+	Types    []string `long:"content-type" env:"CONTENT_TYPES" env-delim:"," description:"Scripts directory for requests content type in type=dir format (ex: application/json=/srv/json or text/*=/srv/text). Can be repeated. Other requests are served as usual"`
+	Rewrites []string `long:"rewrite" env:"REWRITES" env-delim:"," description:"Rewrite request path before lookup in scripts directories by regular expression in pattern=replacement format (ex: ^/deploy$=/v2/deploy.sh). Can be repeated, the first matched rule applied"`
 }
 
 type CmdRun struct {
-	Args struct {
+	Env      []string `long:"env" env:"SCRIPT_ENV" env-delim:"," description:"Environment variable for script in KEY=VALUE format. Can be repeated. Overrides variables from headers and query"`
+	Template bool     `long:"template" env:"TEMPLATE" description:"Expand Go templates in arguments by request data (ex: {{.Query.branch}}). Requests with missed values are rejected"`
+	Args     struct {
 		Binary string   `positional-arg:"binary" required:"true" description:"binary to run"`
 		Args   []string `positional-arg:"args"  description:"arguments"`
 	} `positional-args:"yes"`
@@ -82,8 +184,30 @@ type CmdToken struct {
 	} `positional-args:"yes"`
 }
 
+type CmdSign struct {
+	Expiration time.Duration `short:"e" long:"expiration" env:"EXPIRATION" description:"Signed URL expiration" default:"1h"`
+	Args       struct {
+		Path string `positional-arg:"path" required:"true" description:"hook path (ex: /deploy)"`
+	} `positional-args:"yes"`
+}
+
+type CmdVerify struct {
+	Args struct {
+		Token string `positional-arg:"token" required:"true" description:"token to verify"`
+	} `positional-args:"yes"`
+}
+
 var config Config
 
+// token audiences required for admin endpoints
+const (
+	shutdownAction = "shutdown"
+	debugAction    = "debug"
+)
+
+// openAPIPath is path of OpenAPI description of scripts (see --openapi)
+const openAPIPath = "/_openapi.json"
+
 func main() {
 	parser := flags.NewParser(&config, flags.Default)
 	parser.ShortDescription = "Yet another webhooks daemon"
@@ -93,16 +217,27 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	if config.LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	switch parser.Active.Name {
 	case "serve":
-		err = serve(ctx)
+		if err = serve(ctx); errors.Is(err, errCheckFailed) {
+			os.Exit(1)
+		}
 	case "run":
 		err = run(ctx)
 	case "token":
 		err = token()
+	case "sign":
+		err = sign()
+	case "verify":
+		if err = verify(); errors.Is(err, errInvalidToken) {
+			os.Exit(1)
+		}
 	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, context.Canceled) {
 		panic(err)
@@ -110,49 +245,311 @@ func main() {
 }
 
 func serve(global context.Context) error {
-	rootPath, err := filepath.Abs(config.Serve.Args.Scripts)
+	if config.Serve.Args.Scripts == "" && config.Serve.Routes == "" && len(config.Serve.Hosts) == 0 {
+		return errors.New("scripts directory, routes file or hosts should be defined")
+	}
+
+	var rewrites = make([]wd.RewriteRule, 0, len(config.Serve.Rewrites))
+	for _, rule := range config.Serve.Rewrites {
+		rewrite, err := wd.ParseRewriteRule(rule)
+		if err != nil {
+			return err
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+
+	var dirs []*wd.DirectoryRunner
+	var watchers []io.Closer
+	defer func() {
+		for _, watcher := range watchers {
+			_ = watcher.Close()
+		}
+	}()
+	scriptsRunner := func(dir string) (wd.Runner, error) {
+		path, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("detect scripts path: %w", err)
+		}
+		dirRunner := &wd.DirectoryRunner{
+			AllowDotFiles: config.Serve.EnableDotFiles,
+			ScriptsDir:    path,
+			IndexFile:     config.Serve.IndexFile,
+		}
+		dirs = append(dirs, dirRunner)
+		var runner wd.Runner = dirRunner
+		if config.Serve.Watch && !config.Serve.Check {
+			cached, err := wd.NewCachedDirectoryRunner(dirRunner)
+			if err != nil {
+				return nil, fmt.Errorf("watch scripts dir: %w", err)
+			}
+			watchers = append(watchers, cached)
+			runner = cached
+		}
+		if len(rewrites) > 0 {
+			runner = &wd.RewriteRunner{Rules: rewrites, Runner: runner}
+		}
+		if config.Serve.Header != "" {
+			runner = &wd.HeaderRouter{Header: config.Serve.Header, Runner: runner}
+		}
+		return runner, nil
+	}
+
+	var runners wd.MultiRunner
+	if config.Serve.Routes != "" {
+		routes, err := wd.NewConfigRunner(config.Serve.Routes)
+		if err != nil {
+			return fmt.Errorf("load routes: %w", err)
+		}
+		go reloadOnSignal(global, routes)
+		runners = append(runners, routes)
+	}
+
+	var mainDir *wd.DirectoryRunner
+	if config.Serve.Args.Scripts != "" {
+		dirRunner, err := scriptsRunner(config.Serve.Args.Scripts)
+		if err != nil {
+			return err
+		}
+		mainDir = dirs[len(dirs)-1]
+		runners = append(runners, dirRunner)
+	}
+
+	var runner wd.Runner = runners
+	if len(config.Serve.Hosts) > 0 {
+		hosts := make(map[string]wd.Runner, len(config.Serve.Hosts))
+		for _, pair := range config.Serve.Hosts {
+			host, dir, ok := strings.Cut(pair, "=")
+			if !ok || host == "" || dir == "" {
+				return fmt.Errorf("host should be in host=dir format: %s", pair)
+			}
+			hostRunner, err := scriptsRunner(dir)
+			if err != nil {
+				return fmt.Errorf("host %s: %w", host, err)
+			}
+			hosts[strings.ToLower(host)] = hostRunner
+		}
+		runner = &wd.HostRouter{Hosts: hosts, Default: runners}
+	}
+
+	if len(config.Serve.Types) > 0 {
+		types := make(map[string]wd.Runner, len(config.Serve.Types))
+		for _, pair := range config.Serve.Types {
+			contentType, dir, ok := strings.Cut(pair, "=")
+			if !ok || contentType == "" || dir == "" {
+				return fmt.Errorf("content type should be in type=dir format: %s", pair)
+			}
+			typeRunner, err := scriptsRunner(dir)
+			if err != nil {
+				return fmt.Errorf("content type %s: %w", contentType, err)
+			}
+			types[strings.ToLower(contentType)] = typeRunner
+		}
+		runner = &wd.ContentTypeRunner{Types: types, Default: runner}
+	}
+
+	webhooksConfig, err := config.webhooks()
 	if err != nil {
-		return fmt.Errorf("detect scripts path: %w", err)
-	}
-	webhook := wd.New(wd.Config{
-		TempDir:        !config.Serve.DisableIsolation,
-		WorkDir:        config.Serve.WorkDir,
-		Timeout:        config.Timeout,
-		BufferSize:     config.Buffer,
-		ArgType:        config.argType(),
-		Async:          config.asyncMode(),
-		Retries:        config.Retries,
-		Delay:          config.Delay,
-		Workers:        config.Workers,
-		Queue:          config.queue(),
-		Registerer:     prometheus.DefaultRegisterer,
-		RunAsFileOwner: config.Serve.RunAsScriptOwner,
-	}, &wd.DirectoryRunner{
-		AllowDotFiles: config.Serve.EnableDotFiles,
-		ScriptsDir:    rootPath,
-	})
-	return runWebhook(global, webhook)
+		return err
+	}
+	webhooksConfig.TempDir = !config.Serve.DisableIsolation
+	webhooksConfig.WorkDir = config.Serve.WorkDir
+	webhooksConfig.RunAsFileOwner = config.Serve.RunAsScriptOwner
+	webhooksConfig.RunAsUser = config.Serve.RunAsUser
+	webhooksConfig.RunAsGroup = config.Serve.RunAsGroup
+	webhooksConfig.MaxTempDirs = config.Serve.MaxTempDirs
+	webhooksConfig.MinFreeSpace = config.Serve.MinFreeSpace
+	webhooksConfig.NoSupplementaryGroups = config.Serve.NoSupplementary
+
+	if config.Serve.Check {
+		return check(dirs)
+	}
+
+	if config.Serve.Validate || config.Serve.Strict {
+		if err := validate(dirs, config.Serve.Strict); err != nil {
+			return err
+		}
+	}
+
+	var handlers = make(map[string]http.Handler)
+	if config.Serve.OpenAPI {
+		if mainDir == nil {
+			return errors.New("openapi description requires scripts directory")
+		}
+		defaultManifest := wd.Manifest{Async: config.asyncMode()}
+		handlers[openAPIPath] = wd.DescribeHandler("wd", func() ([]wd.Endpoint, error) {
+			return mainDir.Describe(defaultManifest)
+		})
+	}
+
+	return runWebhook(global, webhooksConfig, runner, func(webhooks *wd.Webhooks) error {
+		if err := webhooks.CheckRunAs(); err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if _, err := ioutil.ReadDir(dir.ScriptsDir); err != nil {
+				return fmt.Errorf("scan scripts dir: %w", err)
+			}
+		}
+		return nil
+	}, handlers)
+}
+
+// errCheckFailed indicates that check found problems in scripts.
+var errCheckFailed = errors.New("check failed")
+
+// check validates scripts and returns errCheckFailed if any problem found.
+func check(dirs []*wd.DirectoryRunner) error {
+	var problems int
+	for _, dir := range dirs {
+		for _, problem := range dir.Validate() {
+			fmt.Println(problem)
+			problems++
+		}
+	}
+	if problems > 0 {
+		fmt.Println(problems, "problems found")
+		return errCheckFailed
+	}
+	fmt.Println("no problems found")
+	return nil
+}
+
+// validate scripts before serving and logs found problems. In strict mode, any problem fails startup.
+func validate(dirs []*wd.DirectoryRunner, strict bool) error {
+	var problems int
+	for _, dir := range dirs {
+		for _, problem := range dir.Validate() {
+			slog.Warn("script problem", "dir", dir.ScriptsDir, "error", problem)
+			problems++
+		}
+	}
+	if strict && problems > 0 {
+		return fmt.Errorf("%d problems found in scripts", problems)
+	}
+	return nil
+}
+
+// reloadOnSignal reloads routes on SIGHUP till context canceled.
+func reloadOnSignal(ctx context.Context, routes *wd.ConfigRunner) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			if err := routes.Reload(); err != nil {
+				slog.Error("failed reload routes", "routes", config.Serve.Routes, "error", err)
+			} else {
+				slog.Info("routes reloaded", "routes", config.Serve.Routes)
+			}
+		}
+	}
 }
 
 func run(global context.Context) error {
-	webhook := wd.New(wd.Config{
-		TempDir:        false,
-		WorkDir:        ".",
-		Timeout:        config.Timeout,
-		BufferSize:     config.Buffer,
-		ArgType:        config.argType(),
-		Async:          config.asyncMode(),
-		Retries:        config.Retries,
-		Delay:          config.Delay,
-		Workers:        config.Workers,
-		Queue:          config.queue(),
-		Registerer:     prometheus.DefaultRegisterer,
-		RunAsFileOwner: false,
-	}, wd.StaticScript(config.Run.Args.Binary, config.Run.Args.Args...))
-	return runWebhook(global, webhook)
+	webhooksConfig, err := config.webhooks()
+	if err != nil {
+		return err
+	}
+	webhooksConfig.WorkDir = "."
+
+	override, err := envManifest()
+	if err != nil {
+		return fmt.Errorf("parse manifest from environment: %w", err)
+	}
+	scriptEnv, err := config.Run.scriptEnv()
+	if err != nil {
+		return err
+	}
+	var script wd.Runner = wd.StaticScriptEnv(scriptEnv, config.Run.Args.Binary, config.Run.Args.Args...)
+	if config.Run.Template {
+		script = &wd.TemplateRunner{Runner: script}
+	}
+
+	runner := wd.RunnerFunc(func(req *http.Request, defaultManifest wd.Manifest) *wd.Manifest {
+		manifest := script.Command(req, defaultManifest)
+		if manifest == nil {
+			return nil
+		}
+		manifest.Merge(override)
+		return manifest
+	})
+	return runWebhook(global, webhooksConfig, runner, func(*wd.Webhooks) error {
+		if _, err := exec.LookPath(config.Run.Args.Binary); err != nil {
+			return fmt.Errorf("lookup binary: %w", err)
+		}
+		return nil
+	}, nil)
+}
+
+// scriptEnv parses environment variables for script.
+func (cmd CmdRun) scriptEnv() (map[string]string, error) {
+	var env = make(map[string]string, len(cmd.Env))
+	for _, item := range cmd.Env {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid environment variable %q: KEY=VALUE expected", item)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// envManifest reads script specific parameters for run command from WD_* environment variables: same as xattrs
+// for serve command.
+func envManifest() (wd.Manifest, error) {
+	var manifest wd.Manifest
+	if value := os.Getenv("WD_ASYNC"); value != "" {
+		if err := manifest.Async.UnmarshalText([]byte(value)); err != nil {
+			return manifest, fmt.Errorf("parse WD_ASYNC as async mode: %w", err)
+		}
+	}
+	if value := os.Getenv("WD_TIMEOUT"); value != "" {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return manifest, fmt.Errorf("parse WD_TIMEOUT as duration: %w", err)
+		}
+		manifest.Timeout = v
+	}
+	if value := os.Getenv("WD_DELAY"); value != "" {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return manifest, fmt.Errorf("parse WD_DELAY as duration: %w", err)
+		}
+		manifest.Delay = v
+	}
+	if value := os.Getenv("WD_RETRIES"); value != "" {
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return manifest, fmt.Errorf("parse WD_RETRIES as int: %w", err)
+		}
+		manifest.Retries = uint(v)
+	}
+	if value := os.Getenv("WD_MAX_RESPONSE"); value != "" {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return manifest, fmt.Errorf("parse WD_MAX_RESPONSE as int: %w", err)
+		}
+		manifest.MaxResponse = v
+	}
+	if value := os.Getenv("WD_METHODS"); value != "" {
+		manifest.Methods = strings.Split(value, ",")
+	}
+	if value := os.Getenv("WD_QUERY"); value != "" {
+		manifest.Query = strings.Split(value, ",")
+	}
+	manifest.WorkDir = os.Getenv("WD_WORK_DIR")
+	return manifest, nil
 }
 
 func token() error {
+	secrets := config.signSecrets()
+	if len(secrets) == 0 {
+		return errors.New("secret should be defined")
+	}
+	secret := secrets[0]
 	now := time.Now()
 	claims := jwt.RegisteredClaims{
 		Issuer:   "wd",
@@ -165,7 +562,7 @@ func token() error {
 		claims.ExpiresAt = jwt.NewNumericDate(now.Add(config.Token.Expiration))
 	}
 
-	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Secret))
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
 	if err != nil {
 		return err
 	}
@@ -173,123 +570,330 @@ func token() error {
 	return nil
 }
 
-func runWebhook(global context.Context, webhooks *wd.Webhooks) error {
-	mux := http.NewServeMux()
-	if !config.DisableMetrics {
-		var metricsHandler = promhttp.Handler()
-		if config.SecureMetrics {
-			metricsHandler = protected(config.Secret, metricsHandler)
-		}
-		mux.Handle("/metrics", metricsHandler)
+// runWebhook serves webhooks and additional handlers (path -> handler) till global context canceled. Server is marked
+// as ready and async workers are started after successful prepare.
+func runWebhook(global context.Context, webhooksConfig wd.Config, runner wd.Runner, prepare func(webhooks *wd.Webhooks) error, handlers map[string]http.Handler) error {
+	keyFunc, err := config.keyFunc()
+	if err != nil {
+		return fmt.Errorf("prepare token verification: %w", err)
 	}
 
-	var mainHandler http.Handler = webhooks
+	users, err := config.basicUsers()
+	if err != nil {
+		return fmt.Errorf("prepare basic authorization: %w", err)
+	}
+
+	// in mTLS-only mode clients are authorized by certificates
+	authorize := config.isProtected() && !(config.MTLSCA != "" && config.MTLSOnly)
+
+	if config.RateLimitBy == "subject" && !authorize {
+		return errors.New("rate limit per subject requires authorization (tokens or basic auth)")
+	}
+
+	if config.SubjectLimit > 0 && !authorize {
+		return errors.New("concurrency per subject requires authorization (tokens or basic auth)")
+	}
+
+	if config.DebugRequests && keyFunc == nil {
+		return errors.New("debug requests require tokens (--secret or --jwt-public-key)")
+	}
 
-	if config.PayloadSize > 0 {
-		mainHandler = wd.RequestSizeLimit(config.PayloadSize, mainHandler)
+	asyncWorkers := config.AsyncWorkers
+	if asyncWorkers <= 0 {
+		asyncWorkers = -1 // no workers
 	}
 
-	if len(config.Secret) > 0 {
-		mainHandler = protected(config.Secret, mainHandler)
+	server, err := wd.NewServer(wd.ServerConfig{
+		Config:       webhooksConfig,
+		Runner:       runner,
+		AsyncWorkers: asyncWorkers,
+		HealthChecks: !config.DisableHealth,
+		Middleware: func(mainHandler http.Handler) http.Handler {
+			if config.HMACSecret != "" {
+				mainHandler = wd.VerifyHMAC([]byte(config.HMACSecret), config.HMACHeader, "sha256=")(mainHandler)
+			}
+
+			if len(config.RequireBody) > 0 {
+				mainHandler = wd.RequireBody(config.RequireBody, mainHandler)
+			}
+
+			if config.PayloadSize > 0 {
+				mainHandler = wd.RequestSizeLimit(config.PayloadSize, mainHandler)
+			}
+
+			var debugHandler = mainHandler
+
+			if config.SubjectLimit > 0 {
+				mainHandler = wd.ConcurrencyLimitPerKey(config.SubjectLimit, func(request *http.Request) string {
+					return request.Header.Get("X-Subject")
+				}, mainHandler)
+			}
+
+			if authorize {
+				mainHandler = protected(keyFunc, users, config.signSecrets(), mainHandler)
+			}
+
+			if config.DebugRequests {
+				mainHandler = withDebug(restricted(keyFunc, debugAction, debugHandler), mainHandler)
+			}
+
+			if config.CORS {
+				mainHandler = cors.AllowAll().Handler(mainHandler)
+			}
+			return mainHandler
+		},
+	})
+	if err != nil {
+		return err
 	}
+	webhooks := server.Webhooks()
 
-	if config.CORS {
-		mainHandler = cors.AllowAll().Handler(mainHandler)
+	mux := http.NewServeMux()
+	if !config.DisableMetrics {
+		var metricsHandler = promhttp.Handler()
+		if config.Exemplars {
+			// exemplars are supported only by OpenMetrics format
+			metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+				EnableOpenMetrics: true,
+			}))
+		}
+		if config.SecureMetrics {
+			metricsHandler = protected(keyFunc, users, config.signSecrets(), metricsHandler)
+		}
+		mux.Handle("/metrics", metricsHandler)
 	}
 
-	mux.Handle("/", mainHandler)
+	mux.Handle("/", server.Handler())
+	for path, handler := range handlers {
+		if authorize {
+			handler = protected(keyFunc, users, config.signSecrets(), handler)
+		}
+		mux.Handle(path, handler)
+	}
 
 	srv := http.Server{
 		Addr:    config.Bind,
 		Handler: mux,
 	}
 
-	var wg sync.WaitGroup
-
 	ctx, cancel := context.WithCancel(global)
 	defer cancel()
 
-	wg.Add(1)
+	if config.TasksAPI {
+		var tasksHandler http.Handler = http.StripPrefix(config.tasksPath(), http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			status, err := webhooks.Task(request.Context(), request.URL.Path)
+			if errors.Is(err, wd.ErrTaskNotFound) {
+				http.NotFound(writer, request)
+				return
+			} else if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(status)
+		}))
+		if authorize {
+			tasksHandler = protected(keyFunc, users, config.signSecrets(), tasksHandler)
+		}
+		mux.Handle(config.tasksPath(), tasksHandler)
+	}
+
+	if config.ErrorsAPI {
+		if keyFunc == nil {
+			return errors.New("errors endpoint requires tokens (--secret or --jwt-public-key)")
+		}
+		mux.Handle("/_admin/errors", restricted(keyFunc, debugAction, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(webhooks.LastErrors())
+		})))
+	}
+
+	if config.ShutdownAPI {
+		if keyFunc == nil {
+			return errors.New("shutdown endpoint requires tokens (--secret or --jwt-public-key)")
+		}
+		mux.Handle("/_admin/shutdown", restricted(keyFunc, shutdownAction, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.Method != http.MethodPost {
+				writer.Header().Set("Allow", http.MethodPost)
+				writer.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			slog.Info("shutdown requested by API")
+			writer.WriteHeader(http.StatusAccepted)
+			cancel()
+		})))
+	}
+
+	prepared := make(chan struct{})
+	shutdownDone := make(chan struct{})
 	go func() {
-		defer wg.Wait()
+		defer close(shutdownDone)
 		<-ctx.Done()
-		_ = srv.Close()
+		webhooks.MarkDraining()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancelShutdown()
+		slog.Info("shutting down")
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed gracefully shutdown server", "error", err)
+			_ = srv.Close()
+		}
+		// workers should outlive HTTP server to drain queue
+		select {
+		case <-prepared:
+		case <-shutdownCtx.Done():
+		}
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown deadline reached", "pending", webhooks.Pending())
+		}
+	}()
+
+	prepareErr := make(chan error, 1)
+	go func() {
+		defer close(prepared)
+		err := prepare(webhooks)
+		if err == nil {
+			// workers are stopped by server shutdown
+			err = server.Start(context.Background())
+		}
+		prepareErr <- err
+		if err != nil {
+			cancel()
+			return
+		}
+		slog.Info("ready")
 	}()
 
-	for i := 0; i < config.AsyncWorkers; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			log.Println("worker", i, "started")
-			webhooks.Run(ctx)
-		}(i)
+	slog.Info("started", "bind", config.Bind)
+
+	err = listen(&srv)
+	cancel()
+	<-shutdownDone
+	select {
+	case pErr := <-prepareErr:
+		if pErr != nil {
+			return fmt.Errorf("prepare: %w", pErr)
+		}
+	default:
 	}
-	defer wg.Done()
+	return err
+}
 
-	log.Println("started on", config.Bind)
+func listen(srv *http.Server) error {
+	clientCAs, err := config.clientCAs()
+	if err != nil {
+		return err
+	}
+	if clientCAs != nil && len(config.AutoTLS) == 0 && !config.TLS {
+		return errors.New("client certificates verification (--mtls-ca) requires TLS (--tls or --auto-tls)")
+	}
 
-	switch {
-	case len(config.AutoTLS) > 0:
+	if len(config.AutoTLS) > 0 {
 		manager := &autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
 			Cache:      autocert.DirCache(config.AutoTLSCacheDir),
 			HostPolicy: autocert.HostWhitelist(config.AutoTLS...),
 		}
-		return srv.Serve(manager.Listener())
-	case config.TLS:
-		return srv.ListenAndServeTLS(config.TLSCert, config.TLSKey)
-	default:
-		return srv.ListenAndServe()
+		if clientCAs == nil {
+			return srv.Serve(manager.Listener())
+		}
+		listener, err := net.Listen("tcp", ":443")
+		if err != nil {
+			return err
+		}
+		return srv.Serve(tls.NewListener(listener, withClientCAs(manager.TLSConfig(), clientCAs)))
 	}
-}
 
-func protected(secret string, handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		tokenString := request.Header.Get("Authorization")
-		if tokenString == "" {
-			tokenString = request.URL.Query().Get("token")
+	var listener net.Listener
+	if config.Systemd {
+		l, err := systemdListener()
+		if err != nil {
+			return err
 		}
-		parts := strings.Split(tokenString, " ")
-		tokenString = parts[len(parts)-1]
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(secret), nil
-		})
+		listener = l
+	}
+	if listener == nil {
+		l, err := net.Listen("tcp", config.Bind)
 		if err != nil {
-			writer.WriteHeader(http.StatusForbidden)
-			return
+			return err
 		}
+		listener = l
+	} else {
+		slog.Info("using systemd socket", "address", listener.Addr().String())
+	}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			writer.WriteHeader(http.StatusForbidden)
-			return
+	if config.TLS {
+		if clientCAs != nil {
+			srv.TLSConfig = &tls.Config{
+				ClientCAs:  clientCAs,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			}
 		}
+		return srv.ServeTLS(listener, config.TLSCert, config.TLSKey)
+	}
+	return srv.Serve(listener)
+}
 
-		if allowedAud, ok := claims["aud"].([]string); ok && len(allowedAud) > 0 {
-			requestedAud := strings.Trim(request.URL.Path, "/")
-			allowed := false
-			for _, sub := range allowedAud {
-				if sub == requestedAud {
-					allowed = true
-					break
-				}
-			}
-			if !allowed {
-				writer.WriteHeader(http.StatusForbidden)
-				return
+// clientCAs loads CA bundle for client certificates verification or returns nil if mutual TLS is not used.
+func (cfg Config) clientCAs() (*x509.CertPool, error) {
+	if cfg.MTLSCA == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(cfg.MTLSCA)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.MTLSCA)
+	}
+	return pool, nil
+}
+
+// withClientCAs requires verified client certificate for all connections except ACME TLS-ALPN challenges (used by
+// automatic TLS).
+func withClientCAs(base *tls.Config, clientCAs *x509.CertPool) *tls.Config {
+	withClientAuth := base.Clone()
+	withClientAuth.ClientCAs = clientCAs
+	withClientAuth.ClientAuth = tls.RequireAndVerifyClientCert
+
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return nil, nil
 			}
 		}
+		return withClientAuth, nil
+	}
+	return base
+}
 
-		if sub, ok := claims["sub"].(string); ok {
-			log.Println("authorized request from", sub)
-			request.Header.Set("X-Subject", sub)
-		}
+// taskStore returns store for async tasks statuses or nil if tasks are not tracked.
+func (cfg Config) taskStore() wd.TaskStore {
+	if !cfg.TasksAPI {
+		return nil
+	}
+	return wd.NewMemoryTaskStore(0)
+}
 
-		handler.ServeHTTP(writer, request)
-	})
+// tasksPath returns path prefix of task status endpoint with leading and trailing slashes.
+func (cfg Config) tasksPath() string {
+	return "/" + strings.Trim(cfg.TasksPath, "/") + "/"
+}
+
+// taskLocation returns path prefix for Location header of async requests or empty string if tasks are not tracked.
+func (cfg Config) taskLocation() string {
+	if !cfg.TasksAPI {
+		return ""
+	}
+	return cfg.tasksPath()
+}
+
+func (cfg Config) ioClass() wd.IOClass {
+	var class wd.IOClass
+	if err := class.UnmarshalText([]byte(cfg.IOClass)); err == nil {
+		return class
+	}
+	return wd.IOClassDefault
 }
 
 func (cfg Config) asyncMode() wd.AsyncMode {
@@ -306,6 +910,8 @@ func (cfg Config) argType() wd.ArgType {
 		return wd.ArgTypeParam
 	case "env":
 		return wd.ArgTypeEnv
+	case "file":
+		return wd.ArgTypeFile
 	case "stdin":
 		fallthrough
 	default:
@@ -313,9 +919,215 @@ func (cfg Config) argType() wd.ArgType {
 	}
 }
 
-func (cfg Config) queue() wd.Queue {
-	if config.Queue > 0 {
-		return wd.Limited(config.Queue)
+func (cfg Config) binaryBody() wd.BinaryBody {
+	if cfg.BinaryPayload == "base64" {
+		return wd.BinaryBodyBase64
+	}
+	return wd.BinaryBodyReject
+}
+
+// traceID returns function to get trace ID of request or nil if exemplars are not used.
+func (cfg Config) traceID() func(*http.Request) string {
+	if !cfg.Exemplars {
+		return nil
+	}
+	return wd.TraceParentID
+}
+
+// manifestSecrets returns secrets for verifying manifest override or nil if overrides are not allowed.
+func (cfg Config) manifestSecrets() [][]byte {
+	var secrets = make([][]byte, 0, len(cfg.ManifestSecrets))
+	for _, secret := range cfg.ManifestSecrets {
+		if secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	return secrets
+}
+
+// metricsPath returns function to normalize paths in metrics labels or nil if patterns are not defined.
+func (cfg Config) metricsPath() func(string) string {
+	if len(cfg.MetricsPaths) == 0 {
+		return nil
+	}
+	return wd.PathPatterns(cfg.MetricsPaths...)
+}
+
+func (cfg Config) trustedProxies() ([]netip.Prefix, error) {
+	var prefixes = make([]netip.Prefix, 0, len(cfg.TrustedProxies))
+	for _, cidr := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parse trusted proxy %s: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (cfg Config) headerPattern() (*regexp.Regexp, error) {
+	if cfg.HeaderPattern == "" {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(cfg.HeaderPattern)
+	if err != nil {
+		return nil, fmt.Errorf("parse headers env pattern: %w", err)
+	}
+	return pattern, nil
+}
+
+func (cfg Config) backoff() (wd.BackoffStrategy, error) {
+	var strategy wd.BackoffStrategy
+	if err := strategy.UnmarshalText([]byte(cfg.Backoff)); err != nil {
+		return strategy, fmt.Errorf("parse backoff %s: %w", cfg.Backoff, err)
+	}
+	return strategy, nil
+}
+
+func (cfg Config) rateLimit() (wd.RateLimit, error) {
+	var limit wd.RateLimit
+	if err := limit.UnmarshalText([]byte(cfg.RateLimit)); err != nil {
+		return limit, fmt.Errorf("parse rate limit %s: %w", cfg.RateLimit, err)
+	}
+	return limit, nil
+}
+
+func (cfg Config) rateLimitKey() func(*http.Request) string {
+	if cfg.RateLimitBy != "subject" {
+		return nil
+	}
+	return func(request *http.Request) string {
+		return request.Header.Get("X-Subject")
+	}
+}
+
+func (cfg Config) multiValueEncoding() wd.MultiValueEncoding {
+	if cfg.MultiValue == "indexed" {
+		return wd.MultiValueIndexed
+	}
+	return wd.MultiValueJoin
+}
+
+func (cfg Config) idempotency() wd.IdempotencyStore {
+	if !cfg.Idempotency {
+		return nil
+	}
+	return wd.NewMemoryIdempotencyStore(0)
+}
+
+// webhooks builds webhooks configuration shared by serve and run commands.
+func (cfg Config) webhooks() (wd.Config, error) {
+	queue, err := cfg.queue()
+	if err != nil {
+		return wd.Config{}, err
+	}
+
+	proxies, err := cfg.trustedProxies()
+	if err != nil {
+		return wd.Config{}, err
+	}
+
+	headerPattern, err := cfg.headerPattern()
+	if err != nil {
+		return wd.Config{}, err
+	}
+
+	backoff, err := cfg.backoff()
+	if err != nil {
+		return wd.Config{}, err
+	}
+
+	rateLimit, err := cfg.rateLimit()
+	if err != nil {
+		return wd.Config{}, err
+	}
+
+	return wd.Config{
+		Timeout:        cfg.Timeout,
+		BufferSize:     cfg.Buffer,
+		MaxBufferSize:  cfg.MaxBuffer,
+		FlushInterval:  cfg.FlushInterval,
+		BufferMemory:   cfg.BufferMemory,
+		ArgType:        cfg.argType(),
+		Async:          cfg.asyncMode(),
+		Retries:        cfg.Retries,
+		Delay:          cfg.Delay,
+		Workers:        cfg.Workers,
+		PathWorkers:    cfg.PathWorkers,
+		PerPathWorkers: cfg.PathLimits,
+		MaxConcurrent:  cfg.MaxConcurrent,
+		MaxSpooling:    cfg.MaxSpooling,
+		Queue:          queue,
+		QueueDir:       cfg.QueueDir,
+		Registerer:     prometheus.DefaultRegisterer,
+
+		ParseScriptHeaders:  cfg.ScriptHeaders,
+		SkipBodylessPayload: cfg.SkipBodyless,
+		BinaryBody:          cfg.binaryBody(),
+		MaxCachedBody:       cfg.MaxCachedBody,
+		ExecPath:            cfg.ExecPath,
+
+		DiscardPartialOutput: cfg.DiscardPartial,
+		NoRetryExitCode:      cfg.NoRetryExitCode,
+		MaxAsyncLifetime:     cfg.AsyncLifetime,
+		RedactErrors:         cfg.RedactErrors,
+		Backoff:              backoff,
+		CompletionCallback:   cfg.Callback,
+		MaxRetryAfter:        cfg.MaxRetryAfter,
+		BackoffExitCode:      cfg.BackoffExitCode,
+		RetryBudget:          cfg.RetryBudget,
+		RateLimit:            rateLimit,
+		RateLimitPerClient:   cfg.RateLimitBy == "ip",
+		RateLimitKey:         cfg.rateLimitKey(),
+		Idempotency:          cfg.idempotency(),
+		IdempotencyTTL:       cfg.IdempotencyTTL,
+		RequestDeadline:      cfg.RequestDeadline,
+		Nice:                 cfg.Nice,
+		IOClass:              cfg.ioClass(),
+		AsyncNice:            cfg.AsyncNice,
+		MaxResponseSize:      cfg.MaxResponse,
+		PayloadBuckets:       cfg.PayloadBuckets,
+		ResponseBuckets:      cfg.ResponseBuckets,
+		TimingBuckets:        cfg.TimingBuckets,
+		MultiValueEncoding:   cfg.multiValueEncoding(),
+		TrustedProxies:       proxies,
+		TrustForwarded:       cfg.TrustForwarded,
+		ClientCertPEM:        cfg.MTLSPEM,
+		AllowDebug:           cfg.DebugRequests,
+		Tasks:                cfg.taskStore(),
+		TaskLocation:         cfg.taskLocation(),
+		MetricsPath:          cfg.metricsPath(),
+		TraceID:              cfg.traceID(),
+		ManifestSecrets:      cfg.manifestSecrets(),
+		StrictQuery:          cfg.StrictQuery,
+		AllowedQuery:         cfg.AllowedQuery,
+		HeaderPrefix:         cfg.HeaderPrefix,
+		QueryPrefix:          cfg.QueryPrefix,
+		DisableHeadersEnv:    cfg.NoHeadersEnv,
+		HeaderEnvPattern:     headerPattern,
+		DisableQueryEnv:      cfg.NoQueryEnv,
+	}, nil
+}
+
+func (cfg Config) queue() (wd.Queue, error) {
+	if cfg.RedisURL != "" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse redis url: %w", err)
+		}
+		return wd.RedisQueue(redis.NewClient(opts), cfg.RedisKey, slog.Default()), nil
+	}
+	if cfg.Queue > 0 && cfg.SpillDir != "" {
+		if err := os.MkdirAll(cfg.SpillDir, 0700); err != nil {
+			return nil, fmt.Errorf("create spill dir: %w", err)
+		}
+		return wd.SpillQueue(cfg.Queue, cfg.SpillDir, cfg.SpillSize), nil
+	}
+	if cfg.Queue > 0 {
+		return wd.Limited(cfg.Queue), nil
 	}
-	return wd.Unbound()
+	return wd.Unbound(), nil
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// signature of path and expiration time (unix seconds): hex encoded HMAC-SHA256 over path, new line and expiration.
+func signature(secret []byte, path string, expiration string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + expiration))
+	return mac.Sum(nil)
+}
+
+// signPath returns path with exp and sig query params.
+func signPath(secret []byte, path string, expiresAt time.Time) string {
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	query := url.Values{
+		"exp": []string{exp},
+		"sig": []string{hex.EncodeToString(signature(secret, path, exp))},
+	}
+	return path + "?" + query.Encode()
+}
+
+// checkSignature returns true if request has valid (by any of secrets) not expired signature (exp and sig query
+// params).
+func checkSignature(secrets [][]byte, request *http.Request) bool {
+	query := request.URL.Query()
+	exp := query.Get("exp")
+	expiresAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return false
+	}
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil {
+		return false
+	}
+	for _, secret := range secrets {
+		if hmac.Equal(signature(secret, request.URL.Path, exp), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func sign() error {
+	if len(config.Secrets) == 0 {
+		return errors.New("secret should be defined")
+	}
+	if config.Sign.Expiration <= 0 {
+		return errors.New("expiration should be positive")
+	}
+	fmt.Println(signPath(config.signSecrets()[0], config.Sign.Args.Path, time.Now().Add(config.Sign.Expiration)))
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// first file descriptor passed by systemd (see sd_listen_fds(3))
+const systemdFirstFD = 3
+
+// systemdListener returns listener for the first socket passed by systemd socket activation or nil if process is not
+// socket-activated. Activation variables are removed from environment, so scripts will not inherit them.
+func systemdListener() (net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	if fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || fds < 1 {
+		return nil, nil
+	}
+	file := os.NewFile(systemdFirstFD, "LISTEN_FD_3")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("use systemd socket: %w", err)
+	}
+	return listener, nil
+}
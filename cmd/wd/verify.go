@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// errInvalidToken indicates that verified token is not accepted by server.
+var errInvalidToken = errors.New("invalid token")
+
+// verify prints token claims and checks token by the same rules as protected handler.
+func verify() error {
+	keyFunc, err := config.keyFunc()
+	if err != nil {
+		return err
+	}
+	if keyFunc == nil {
+		return errors.New("secret or public key should be defined")
+	}
+
+	var claims = jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(lastPart(config.Verify.Args.Token), claims); err != nil {
+		fmt.Println("valid:     no (" + err.Error() + ")")
+		return errInvalidToken
+	}
+
+	if sub, ok := claims["sub"].(string); ok {
+		fmt.Println("subject:  ", sub)
+	}
+	if hooks := allowedHooks(claims); len(hooks) > 0 {
+		fmt.Println("hooks:    ", strings.Join(hooks, ", "))
+	} else {
+		fmt.Println("hooks:     all")
+	}
+	fmt.Println("issued:   ", formatClaimTime(claims, "iat", "unknown"))
+	fmt.Println("expires:  ", formatClaimTime(claims, "exp", "never"))
+
+	if _, err := verifyToken(keyFunc, config.Verify.Args.Token); err != nil {
+		fmt.Println("valid:     no (" + err.Error() + ")")
+		return errInvalidToken
+	}
+	fmt.Println("valid:     yes")
+	return nil
+}
+
+func formatClaimTime(claims jwt.MapClaims, name string, fallback string) string {
+	unix, ok := claims[name].(float64)
+	if !ok {
+		return fallback
+	}
+	t := time.Unix(int64(unix), 0)
+	return t.Format(time.RFC3339) + " (" + formatRelative(time.Until(t)) + ")"
+}
+
+func formatRelative(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " ago"
+	}
+	return "in " + d.String()
+}
@@ -0,0 +1,27 @@
+package wd
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+)
+
+// RequestCodec serializes requests for async processing. Encoded request is stored in file (see Config.QueueDir)
+// and decoded before each attempt.
+type RequestCodec interface {
+	// Encode request including body.
+	Encode(w io.Writer, req *http.Request) error
+	// Decode request previously encoded by Encode. Body of request may be read from the reader lazily.
+	Decode(r io.Reader) (*http.Request, error)
+}
+
+// WireCodec stores requests in HTTP/1.1 wire format. It's the default codec.
+type WireCodec struct{}
+
+func (WireCodec) Encode(w io.Writer, req *http.Request) error {
+	return req.Write(w)
+}
+
+func (WireCodec) Decode(r io.Reader) (*http.Request, error) {
+	return http.ReadRequest(bufio.NewReader(r))
+}
@@ -0,0 +1,159 @@
+package wd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reddec/wd/internal"
+)
+
+// Endpoint describes script endpoint (see DirectoryRunner.Describe).
+type Endpoint struct {
+	Path    string    `json:"path"`              // request path (ex: /deploy)
+	Methods []string  `json:"methods,omitempty"` // allowed HTTP methods. Empty means all methods allowed
+	Async   AsyncMode `json:"async"`             // async mode of script
+	Query   []string  `json:"query,omitempty"`   // script specific allowed query params
+}
+
+// Describe all scripts in directory which can be executed by runner. Scripts parameters (xattrs) are applied to
+// default manifest. Directories with IndexFile are described by directory path. Not executable scripts and scripts
+// with invalid parameters are skipped (see Validate).
+func (dr *DirectoryRunner) Describe(defaultManifest Manifest) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	err := filepath.Walk(dr.ScriptsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dr.ScriptsDir {
+			return nil
+		}
+		if !dr.isPathAllowed(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !internal.IsExecutable(path) {
+			return nil
+		}
+		manifest := defaultManifest
+		if err := readAttrs(path, &manifest); err != nil {
+			return nil
+		}
+		relPath, err := filepath.Rel(dr.ScriptsDir, path)
+		if err != nil {
+			return err
+		}
+		requestPath := "/" + filepath.ToSlash(relPath)
+		if dr.IndexFile != "" && info.Name() == dr.IndexFile {
+			requestPath = strings.TrimSuffix(requestPath, dr.IndexFile)
+		}
+		endpoints = append(endpoints, Endpoint{
+			Path:    requestPath,
+			Methods: manifest.Methods,
+			Async:   manifest.Async,
+			Query:   manifest.Query,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk %s: %w", dr.ScriptsDir, err)
+	}
+	return endpoints, nil
+}
+
+// DescribeHandler serves OpenAPI 3 (JSON) description of endpoints returned by describe (ex: DirectoryRunner.Describe).
+// Endpoints without allowed methods are described as GET and POST. Request body and response are opaque binary.
+func DescribeHandler(title string, describe func() ([]Endpoint, error)) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		endpoints, err := describe()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(openAPIDocument(title, endpoints))
+	})
+}
+
+type openAPIOperation struct {
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody               `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Async       AsyncMode                  `json:"x-async"`
+}
+
+type openAPIParameter struct {
+	Name   string            `json:"name"`
+	In     string            `json:"in"`
+	Schema map[string]string `json:"schema"`
+}
+
+type openAPIBody struct {
+	Content map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIMedia struct {
+	Schema map[string]string `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+func openAPIDocument(title string, endpoints []Endpoint) map[string]any {
+	binary := map[string]openAPIMedia{"*/*": {Schema: map[string]string{"type": "string", "format": "binary"}}}
+	paths := make(map[string]map[string]openAPIOperation, len(endpoints))
+	for _, endpoint := range endpoints {
+		var operation = openAPIOperation{
+			Responses: make(map[string]openAPIResponse),
+			Async:     endpoint.Async,
+		}
+		for _, param := range endpoint.Query {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:   param,
+				In:     "query",
+				Schema: map[string]string{"type": "string"},
+			})
+		}
+		if endpoint.Async == AsyncModeAuto {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:   "async",
+				In:     "query",
+				Schema: map[string]string{"type": "boolean"},
+			})
+		}
+		if endpoint.Async != AsyncModeForced {
+			operation.Responses["200"] = openAPIResponse{Description: "script output", Content: binary}
+		}
+		if endpoint.Async != AsyncModeDisabled {
+			operation.Responses["202"] = openAPIResponse{Description: "request accepted for async processing"}
+		}
+
+		methods := endpoint.Methods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet, http.MethodPost}
+		}
+		item := make(map[string]openAPIOperation, len(methods))
+		for _, method := range methods {
+			op := operation
+			switch strings.ToUpper(method) {
+			case http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodOptions:
+			default:
+				op.RequestBody = &openAPIBody{Content: binary}
+			}
+			item[strings.ToLower(method)] = op
+		}
+		paths[endpoint.Path] = item
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": title, "version": "1.0.0"},
+		"paths":   paths,
+	}
+}
@@ -0,0 +1,163 @@
+package wd
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is request header with client-generated key to deduplicate retried requests
+	// (see Config.Idempotency).
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set to true in responses replayed for duplicated requests.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// DefaultIdempotencyTTL is default time to remember idempotency keys.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKey is maximum length of idempotency key.
+	maxIdempotencyKey = 255
+)
+
+// IdempotencyRecord is result of request with idempotency key.
+type IdempotencyRecord struct {
+	Status int    `json:"status"`            // response status code, zero while request in progress
+	TaskID string `json:"task_id,omitempty"` // ID of task for async request (see Config.Tasks)
+}
+
+// IdempotencyStore keeps results of requests by idempotency keys. Implementation should be safe for concurrent use.
+type IdempotencyStore interface {
+	// Reserve key for ttl. Returns nil if key was not known and now reserved by caller, otherwise returns record of
+	// the previous request with the same key.
+	Reserve(ctx context.Context, key string, ttl time.Duration) (*IdempotencyRecord, error)
+	// Set result of request for reserved key.
+	Set(ctx context.Context, key string, record IdempotencyRecord, ttl time.Duration) error
+	// Release reserved key, so request with the same key can be processed again.
+	Release(ctx context.Context, key string) error
+}
+
+// NewMemoryIdempotencyStore creates in-memory idempotency store. Number of keys is limited: expired keys are removed
+// once limit reached, then keys with the nearest expiration. Zero or negative limit means default (8192).
+func NewMemoryIdempotencyStore(limit int) IdempotencyStore {
+	if limit <= 0 {
+		limit = maxTasks
+	}
+	return &memoryIdempotencyStore{limit: limit, keys: make(map[string]idempotencyEntry)}
+}
+
+type memoryIdempotencyStore struct {
+	lock  sync.Mutex
+	limit int
+	keys  map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	record  IdempotencyRecord
+	expires time.Time
+}
+
+func (ms *memoryIdempotencyStore) Reserve(_ context.Context, key string, ttl time.Duration) (*IdempotencyRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	if entry, ok := ms.keys[key]; ok && now.Before(entry.expires) {
+		return &entry.record, nil
+	}
+	if len(ms.keys) >= ms.limit {
+		ms.evict(now)
+	}
+	ms.keys[key] = idempotencyEntry{expires: now.Add(ttl)}
+	return nil, nil
+}
+
+func (ms *memoryIdempotencyStore) Set(_ context.Context, key string, record IdempotencyRecord, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.keys[key] = idempotencyEntry{record: record, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (ms *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.keys, key)
+	return nil
+}
+
+// evict expired keys or the key with the nearest expiration if nothing expired.
+func (ms *memoryIdempotencyStore) evict(now time.Time) {
+	var nearestKey string
+	var nearest time.Time
+	for key, entry := range ms.keys {
+		if !now.Before(entry.expires) {
+			delete(ms.keys, key)
+			continue
+		}
+		if nearestKey == "" || entry.expires.Before(nearest) {
+			nearestKey = key
+			nearest = entry.expires
+		}
+	}
+	if len(ms.keys) >= ms.limit {
+		delete(ms.keys, nearestKey)
+	}
+}
+
+// reserveIdempotencyKey reserves idempotency key of request (see Config.Idempotency). Returns empty key if request
+// should be processed without deduplication. Returns true if response already written: replayed result of the
+// previous request or error. Store errors are only logged and request processed as usual.
+func (wh *Webhooks) reserveIdempotencyKey(writer http.ResponseWriter, req *http.Request) (string, bool) {
+	key := req.Header.Get(IdempotencyKeyHeader)
+	if wh.config.Idempotency == nil || key == "" || wh.isDebugRequest(req) {
+		return "", false
+	}
+	if len(key) > maxIdempotencyKey {
+		http.Error(writer, "too long idempotency key", http.StatusBadRequest)
+		return "", true
+	}
+	// the same key may be used for different hooks
+	key = req.URL.Path + " " + key
+	record, err := wh.config.Idempotency.Reserve(req.Context(), key, wh.config.IdempotencyTTL)
+	if err != nil {
+		wh.config.Logger.Warn("failed reserve idempotency key", "path", req.URL.Path, "error", err)
+		return "", false
+	}
+	if record == nil {
+		return key, false
+	}
+	wh.replayedNum.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+	if record.Status == 0 {
+		http.Error(writer, "request with the same idempotency key is in progress", http.StatusConflict)
+		return "", true
+	}
+	wh.config.Logger.Info("replayed result of duplicated request", "path", req.URL.Path, "status", record.Status)
+	writer.Header().Set(IdempotentReplayedHeader, strconv.FormatBool(true))
+	if record.TaskID != "" {
+		writer.Header().Set("X-Task-Id", record.TaskID)
+		if wh.config.TaskLocation != "" {
+			writer.Header().Set("Location", wh.config.TaskLocation+record.TaskID)
+		}
+	}
+	writer.WriteHeader(record.Status)
+	if record.TaskID != "" {
+		_, _ = writer.Write([]byte(record.TaskID))
+	}
+	return "", true
+}
+
+// completeIdempotencyKey saves result of request for reserved key. If request has not been executed or enqueued
+// (ex: canceled while waiting for worker), key is released, so request can be retried.
+func (wh *Webhooks) completeIdempotencyKey(key string, dispatched bool, status int, taskID string) {
+	// request context may be already canceled
+	ctx := context.Background()
+	var err error
+	if dispatched {
+		err = wh.config.Idempotency.Set(ctx, key, IdempotencyRecord{Status: status, TaskID: taskID}, wh.config.IdempotencyTTL)
+	} else {
+		err = wh.config.Idempotency.Release(ctx, key)
+	}
+	if err != nil {
+		wh.config.Logger.Warn("failed save idempotency key", "error", err)
+	}
+}
@@ -3,11 +3,17 @@
 package internal
 
 import (
+	"bufio"
+	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func SetCreds(cmd *exec.Cmd, file string) error {
@@ -24,13 +30,188 @@ func SetCreds(cmd *exec.Cmd, file string) error {
 		Gid: stats.Gid,
 	}
 
-	if u, err := user.LookupId(strconv.FormatUint(uint64(stats.Uid), 10)); err == nil {
-		// might not work in MacOSx with CGO_ENABLED=0 - see https://github.com/golang/go/issues/24383
+	if u := owners.Lookup(stats.Uid); u != nil {
 		cmd.Env = append(cmd.Env, "USER="+u.Username, "HOME="+u.HomeDir)
 	}
 	return nil
 }
 
+// LookupCredential resolves user and group by names or numeric IDs. Empty user means current user. Empty group means
+// primary group of the user; group is required for numeric user ID without account.
+func LookupCredential(userName, groupName string) (*Credential, error) {
+	var account *user.User
+	var cred Credential
+	switch {
+	case userName == "":
+		cred.UID = uint32(os.Getuid())
+		account = owners.Lookup(cred.UID)
+	case isNumeric(userName):
+		uid, err := strconv.ParseUint(userName, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parse uid %s: %w", userName, err)
+		}
+		cred.UID = uint32(uid)
+		account = owners.Lookup(cred.UID)
+	default:
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return nil, fmt.Errorf("lookup user %s: %w", userName, err)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parse uid %s of user %s: %w", u.Uid, userName, err)
+		}
+		cred.UID = uint32(uid)
+		account = u
+	}
+	if account != nil {
+		cred.Username = account.Username
+		cred.HomeDir = account.HomeDir
+	}
+
+	gid := groupName
+	switch {
+	case groupName == "" && account != nil:
+		gid = account.Gid
+	case groupName == "" && userName == "":
+		gid = strconv.Itoa(os.Getgid())
+	case groupName == "":
+		return nil, fmt.Errorf("group should be defined for user %s without account", userName)
+	case !isNumeric(groupName):
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, fmt.Errorf("lookup group %s: %w", groupName, err)
+		}
+		gid = g.Gid
+	}
+	parsedGID, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse gid %s: %w", gid, err)
+	}
+	cred.GID = uint32(parsedGID)
+	return &cred, nil
+}
+
+// SetCredential configures command to run as user and group from credential. USER and HOME environment variables
+// are set for users with account.
+func SetCredential(cmd *exec.Cmd, cred *Credential) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: cred.UID,
+		Gid: cred.GID,
+	}
+	if cred.Username != "" {
+		cmd.Env = append(cmd.Env, "USER="+cred.Username, "HOME="+cred.HomeDir)
+	}
+}
+
+// SetSupplementaryGroups adds supplementary groups of user from command credential (see SetCreds and SetCredential).
+// Command runs only with primary group if credential is not set, user has no account or lookup failed (error
+// returned).
+func SetSupplementaryGroups(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		return nil
+	}
+	groups, err := owners.Groups(cmd.SysProcAttr.Credential.Uid)
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr.Credential.Groups = groups
+	return nil
+}
+
+// Chown changes owner of path to user and group from credential.
+func Chown(path string, cred *Credential) error {
+	return os.Chown(path, int(cred.UID), int(cred.GID))
+}
+
+func isNumeric(value string) bool {
+	return value != "" && strings.Trim(value, "0123456789") == ""
+}
+
+// userCacheTTL defines how long results of users lookup (by uid) are cached.
+const userCacheTTL = time.Minute
+
+var owners = &userCache{ttl: userCacheTTL, users: make(map[uint32]cachedUser)}
+
+type cachedUser struct {
+	user    *user.User // nil if not found
+	groups  []uint32   // supplementary groups, nil if not yet resolved
+	expires time.Time
+}
+
+// userCache caches users lookup by uid, since lookup could be slow (ex: network-backed NSS).
+type userCache struct {
+	ttl   time.Duration
+	lock  sync.Mutex
+	users map[uint32]cachedUser
+}
+
+// Lookup user by uid. Returns nil if user not found.
+func (uc *userCache) Lookup(uid uint32) *user.User {
+	now := time.Now()
+	uc.lock.Lock()
+	cached, ok := uc.users[uid]
+	uc.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.user
+	}
+
+	// might not work in MacOSx with CGO_ENABLED=0 - see https://github.com/golang/go/issues/24383
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		u = nil
+	}
+
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	// remove expired to keep cache bounded by number of actual owners
+	for id, entry := range uc.users {
+		if !now.Before(entry.expires) {
+			delete(uc.users, id)
+		}
+	}
+	uc.users[uid] = cachedUser{user: u, expires: now.Add(uc.ttl)}
+	return u
+}
+
+// Groups returns supplementary group IDs of user by uid (cached same as Lookup). Returns nil if user not found.
+func (uc *userCache) Groups(uid uint32) ([]uint32, error) {
+	u := uc.Lookup(uid)
+	if u == nil {
+		return nil, nil
+	}
+	uc.lock.Lock()
+	cached := uc.users[uid]
+	uc.lock.Unlock()
+	if cached.groups != nil {
+		return cached.groups, nil
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("lookup groups of user %s: %w", u.Username, err)
+	}
+	var groups = make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		gid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parse gid %s of user %s: %w", id, u.Username, err)
+		}
+		groups = append(groups, uint32(gid))
+	}
+
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	if entry, ok := uc.users[uid]; ok {
+		entry.groups = groups
+		uc.users[uid] = entry
+	}
+	return groups, nil
+}
+
 func ChownAsFile(path string, file string) error {
 	var stats syscall.Stat_t
 	err := syscall.Stat(file, &stats)
@@ -39,3 +220,44 @@ func ChownAsFile(path string, file string) error {
 	}
 	return os.Chown(path, int(stats.Uid), int(stats.Gid))
 }
+
+// IsExecutable returns true if file is regular file with any execute permission bit.
+func IsExecutable(file string) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// CheckShebang verifies that interpreter from shebang line (if any) exists and executable. For /usr/bin/env
+// interpreter, the first argument is looked up in PATH.
+func CheckShebang(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return nil // binary or no shebang - up to kernel
+	}
+	if err != nil && line == "" {
+		return err
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty shebang")
+	}
+	interpreter := fields[0]
+	if !IsExecutable(interpreter) {
+		return fmt.Errorf("interpreter %s not found or not executable", interpreter)
+	}
+	if filepath.Base(interpreter) == "env" && len(fields) > 1 && !strings.HasPrefix(fields[1], "-") {
+		if _, err := exec.LookPath(fields[1]); err != nil {
+			return fmt.Errorf("interpreter %s not found in PATH", fields[1])
+		}
+	}
+	return nil
+}
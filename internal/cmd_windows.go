@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"os"
 	"os/exec"
 )
 
@@ -11,3 +12,35 @@ func SetCreds(cmd *exec.Cmd, file string) error {
 func ChownAsFile(path string, file string) error {
 	return nil
 }
+
+// LookupCredential is not supported on Windows.
+func LookupCredential(userName, groupName string) (*Credential, error) {
+	return nil, ErrUnsupported
+}
+
+// SetCredential is no-op on Windows.
+func SetCredential(cmd *exec.Cmd, cred *Credential) {}
+
+// SetSupplementaryGroups is no-op on Windows.
+func SetSupplementaryGroups(cmd *exec.Cmd) error {
+	return nil
+}
+
+// Chown is no-op on Windows.
+func Chown(path string, cred *Credential) error {
+	return nil
+}
+
+// IsExecutable returns true if file is regular file. Windows has no execute permission bit.
+func IsExecutable(file string) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular()
+}
+
+// CheckShebang is no-op on Windows since shebang is not supported.
+func CheckShebang(file string) error {
+	return nil
+}
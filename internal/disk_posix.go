@@ -0,0 +1,16 @@
+//go:build !windows
+
+package internal
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns number of bytes available for unprivileged user on file system with the path.
+func FreeSpace(path string) (uint64, error) {
+	var stats syscall.Statfs_t
+	if err := syscall.Statfs(path, &stats); err != nil {
+		return 0, err
+	}
+	return stats.Bavail * uint64(stats.Bsize), nil
+}
@@ -0,0 +1,6 @@
+package internal
+
+// FreeSpace is not supported on Windows.
+func FreeSpace(path string) (uint64, error) {
+	return 0, ErrUnsupported
+}
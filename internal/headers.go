@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// StatusHeader is pseudo-header which defines response status code.
+const StatusHeader = "Status"
+
+func NewHeaderParser(upstream http.ResponseWriter, limit int) *HeaderParser {
+	return &HeaderParser{
+		limit:    limit,
+		upstream: upstream,
+	}
+}
+
+// HeaderParser detects RFC822-style header block (terminated by blank line) at the beginning of stream and
+// copies parsed headers to upstream. Remaining data streamed as-is. In case block not found within limit or
+// can not be parsed, all data will be passed to upstream without modifications.
+type HeaderParser struct {
+	limit    int
+	done     bool
+	buffer   bytes.Buffer
+	upstream http.ResponseWriter
+}
+
+func (hp *HeaderParser) Write(data []byte) (int, error) {
+	if hp.done {
+		return hp.upstream.Write(data)
+	}
+	hp.buffer.Write(data)
+	content := hp.buffer.Bytes()
+	if end := headersEnd(content); end >= 0 {
+		hp.done = true
+		if hp.applyHeaders(content[:end]) {
+			content = content[end:]
+		}
+		return len(data), hp.flush(content)
+	}
+	if hp.buffer.Len() >= hp.limit {
+		hp.done = true
+		return len(data), hp.flush(content)
+	}
+	return len(data), nil
+}
+
+// Close flushes cached data (if any) as-is. It doesn't close upstream.
+func (hp *HeaderParser) Close() error {
+	if hp.done {
+		return nil
+	}
+	hp.done = true
+	return hp.flush(hp.buffer.Bytes())
+}
+
+func (hp *HeaderParser) flush(content []byte) error {
+	defer func() {
+		hp.buffer = bytes.Buffer{} // release allocated memory
+	}()
+	if len(content) == 0 {
+		return nil
+	}
+	_, err := hp.upstream.Write(content)
+	return err
+}
+
+func (hp *HeaderParser) applyHeaders(block []byte) bool {
+	headers, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+	if err != nil {
+		return false
+	}
+	status := http.StatusOK
+	if value := headers.Get(StatusHeader); value != "" {
+		code, err := strconv.Atoi(strings.Fields(value)[0])
+		if err != nil || code < 100 || code > 999 {
+			return false
+		}
+		status = code
+		headers.Del(StatusHeader)
+	}
+	target := hp.upstream.Header()
+	for k, v := range headers {
+		target[k] = append(target[k], v...)
+	}
+	hp.upstream.WriteHeader(status)
+	return true
+}
+
+// headersEnd returns position right after blank line or -1.
+func headersEnd(content []byte) int {
+	lf := bytes.Index(content, []byte("\n\n"))
+	crlf := bytes.Index(content, []byte("\r\n\r\n"))
+	switch {
+	case lf < 0 && crlf < 0:
+		return -1
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return crlf + 4
+	default:
+		return lf + 2
+	}
+}
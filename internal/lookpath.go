@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"os/exec"
+	"path/filepath"
+)
+
+// LookPath searches for an executable file in directories from search path (same format as PATH variable).
+// Relative directories (including empty and ".") are skipped: otherwise result would depend on current directory or,
+// for bare file name, be resolved again by exec in inherited PATH.
+func LookPath(file string, searchPath string) (string, error) {
+	for _, dir := range filepath.SplitList(searchPath) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		candidate := filepath.Join(dir, file)
+		if IsExecutable(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package internal
+
+// SetPriority is supported only on Linux. Returns ErrUnsupported if any non-zero value requested.
+func SetPriority(pid int, nice int, ioClass int) error {
+	if nice != 0 || ioClass != 0 {
+		return ErrUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioLevel      = 4 // default level inside real-time and best-effort classes
+)
+
+// SetPriority sets niceness and IO scheduling class (see ioprio_set(2): 1 - real-time, 2 - best-effort, 3 - idle) of
+// process. Zero values are ignored. Negative niceness and real-time class require privileges (CAP_SYS_NICE or
+// CAP_SYS_ADMIN).
+func SetPriority(pid int, nice int, ioClass int) error {
+	if nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+			return fmt.Errorf("set niceness %d: %w", nice, err)
+		}
+	}
+	if ioClass != 0 {
+		prio := ioClass << ioprioClassShift
+		if ioClass != 3 {
+			prio |= ioprioLevel
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("set IO class %d: %w", ioClass, errno)
+		}
+	}
+	return nil
+}
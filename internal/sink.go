@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"io"
+)
+
+func NewSinkReader(source io.ReadCloser, sinks ...io.Writer) *SinkReader {
+	return &SinkReader{
+		source: source,
+		sinks:  sinks,
+	}
+}
+
+// SinkReader wraps any ReadCloser and copies consumed data to all sinks in one pass without caching, similar to
+// io.TeeReader for several writers. Sink errors are returned as read errors.
+type SinkReader struct {
+	source io.ReadCloser
+	sinks  []io.Writer
+}
+
+func (sr *SinkReader) Read(p []byte) (n int, err error) {
+	n, err = sr.source.Read(p)
+	if n > 0 {
+		for _, sink := range sr.sinks {
+			if _, sinkErr := sink.Write(p[:n]); sinkErr != nil {
+				return n, sinkErr
+			}
+		}
+	}
+	return
+}
+
+func (sr *SinkReader) Close() error {
+	return sr.source.Close()
+}
+
+// Counter is sink which counts written bytes.
+type Counter struct {
+	total int
+}
+
+func (c *Counter) Write(p []byte) (int, error) {
+	c.total += len(p)
+	return len(p), nil
+}
+
+func (c *Counter) Total() int {
+	return c.total
+}
@@ -0,0 +1,32 @@
+package internal
+
+// NewTailBuffer creates buffer which keeps only last size bytes.
+func NewTailBuffer(size int) *TailBuffer {
+	return &TailBuffer{size: size}
+}
+
+// TailBuffer keeps only last written bytes (ex: for stderr of scripts). Not thread-safe.
+type TailBuffer struct {
+	size int
+	data []byte
+}
+
+func (tb *TailBuffer) Write(p []byte) (int, error) {
+	if len(p) >= tb.size {
+		tb.data = append(tb.data[:0], p[len(p)-tb.size:]...)
+		return len(p), nil
+	}
+	tb.data = append(tb.data, p...)
+	if extra := len(tb.data) - tb.size; extra > 0 {
+		tb.data = append(tb.data[:0], tb.data[extra:]...)
+	}
+	return len(p), nil
+}
+
+func (tb *TailBuffer) String() string {
+	return string(tb.data)
+}
+
+func (tb *TailBuffer) Bytes() []byte {
+	return tb.data
+}
@@ -2,35 +2,22 @@ package internal
 
 import (
 	"bytes"
-	"io"
+	"errors"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func NewMeteredStream(source io.ReadCloser) *MeteredStream {
-	return &MeteredStream{
-		source: source,
-	}
-}
-
-// MeteredStream wraps any ReadCloser and count consumed bytes.
-type MeteredStream struct {
-	read   int
-	source io.ReadCloser
-}
-
-func (ms *MeteredStream) Read(p []byte) (n int, err error) {
-	n, err = ms.source.Read(p)
-	ms.read += n
-	return
-}
+// ErrUnsupported indicates that operation is not supported on current platform.
+var ErrUnsupported = errors.New("not supported")
 
-func (ms *MeteredStream) Close() error {
-	return ms.source.Close()
-}
-
-func (ms *MeteredStream) Total() int {
-	return ms.read
+// Credential defines user and group to run commands (see LookupCredential).
+type Credential struct {
+	UID      uint32
+	GID      uint32
+	Username string // empty if user has no account
+	HomeDir  string // empty if user has no account
 }
 
 func NewBufferedStream(upstream http.ResponseWriter, bufferSize int) *BufferedResponse {
@@ -41,7 +28,11 @@ func NewBufferedStream(upstream http.ResponseWriter, bufferSize int) *BufferedRe
 	}
 }
 
+// BufferedResponse buffers output till buffer size reached or Flush called. All methods are thread-safe except
+// Header.
 type BufferedResponse struct {
+	lock        sync.Mutex
+	dirty       bool // data written to upstream, but not yet flushed to network
 	bufferSize  int
 	statusCode  int
 	created     time.Time
@@ -56,24 +47,51 @@ func (br *BufferedResponse) Header() http.Header {
 }
 
 func (br *BufferedResponse) Write(data []byte) (int, error) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
 	if br.headersSent || br.bufferSize <= 0 {
-		_ = br.Flush()
+		_ = br.flush()
 		v, err := br.upstream.Write(data)
 		br.sent += v
+		br.dirty = br.dirty || v > 0
 		return v, err
 	}
 	br.buffer.Write(data)
 	if br.buffer.Len() < br.bufferSize {
 		return len(data), nil
 	}
-	return len(data), br.Flush()
+	return len(data), br.flush()
 }
 
 func (br *BufferedResponse) WriteHeader(statusCode int) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
 	br.statusCode = statusCode
 }
 
 func (br *BufferedResponse) Flush() error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	return br.flush()
+}
+
+// FlushPending sends buffered data (if any) and flushes written data to network if upstream supports it
+// (http.Flusher). Does nothing if nothing written since last call, so headers are not sent without data.
+func (br *BufferedResponse) FlushPending() error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if br.buffer.Len() == 0 && !br.dirty {
+		return nil
+	}
+	err := br.flush()
+	if flusher, ok := br.upstream.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	br.dirty = false
+	return err
+}
+
+func (br *BufferedResponse) flush() error {
 	if br.headersSent {
 		return nil
 	}
@@ -88,15 +106,42 @@ func (br *BufferedResponse) Flush() error {
 	}
 	v, err := br.upstream.Write(br.buffer.Bytes())
 	br.sent += v
+	br.dirty = br.dirty || v > 0
 	br.buffer = bytes.Buffer{} // release allocated memory
 	return err
 }
 
+// Finish response: in case nothing sent yet, all output is in buffer, so Content-Length (if not set) can be defined.
+func (br *BufferedResponse) Finish() error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if !br.headersSent && br.upstream.Header().Get("Content-Length") == "" {
+		br.upstream.Header().Set("Content-Length", strconv.Itoa(br.buffer.Len()))
+	}
+	return br.flush()
+}
+
+// Discard buffered but not yet sent data. Returns number of discarded bytes.
+func (br *BufferedResponse) Discard() int {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if br.headersSent {
+		return 0
+	}
+	size := br.buffer.Len()
+	br.buffer = bytes.Buffer{}
+	return size
+}
+
 func (br *BufferedResponse) StatusCode() int {
+	br.lock.Lock()
+	defer br.lock.Unlock()
 	return br.statusCode
 }
 
 func (br *BufferedResponse) Total() int {
+	br.lock.Lock()
+	defer br.lock.Unlock()
 	return br.sent
 }
 
@@ -105,5 +150,7 @@ func (br *BufferedResponse) Duration() time.Duration {
 }
 
 func (br *BufferedResponse) HeadersSent() bool {
+	br.lock.Lock()
+	defer br.lock.Unlock()
 	return br.headersSent
 }
@@ -0,0 +1,96 @@
+package wd
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLastErrors is maximum number of paths with tracked last error.
+const maxLastErrors = 1024
+
+// PathError is last error of script execution for path.
+type PathError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// lastErrors keeps last error per path. Number of paths is limited: the oldest error is evicted once limit reached.
+type lastErrors struct {
+	lock   sync.Mutex
+	limit  int
+	redact bool // keep only class of error (see errorClass)
+	errors map[string]PathError
+}
+
+func newLastErrors(limit int, redact bool) *lastErrors {
+	return &lastErrors{limit: limit, redact: redact, errors: make(map[string]PathError)}
+}
+
+func (le *lastErrors) Record(path string, err error) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if _, exists := le.errors[path]; !exists && len(le.errors) >= le.limit {
+		le.evictOldest()
+	}
+	message := err.Error()
+	if le.redact {
+		message = errorClass(err)
+	}
+	le.errors[path] = PathError{Error: message, Time: time.Now()}
+}
+
+func (le *lastErrors) Snapshot() map[string]PathError {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	var cp = make(map[string]PathError, len(le.errors))
+	for path, pathErr := range le.errors {
+		cp[path] = pathErr
+	}
+	return cp
+}
+
+func (le *lastErrors) evictOldest() {
+	var oldestPath string
+	var oldest time.Time
+	for path, pathErr := range le.errors {
+		if oldestPath == "" || pathErr.Time.Before(oldest) {
+			oldestPath = path
+			oldest = pathErr.Time
+		}
+	}
+	delete(le.errors, oldestPath)
+}
+
+// knownErrors are errors without sensitive details, which could be exposed as is.
+var knownErrors = []error{
+	ErrTooBigRequest,
+	ErrTooBigResponse,
+	ErrRequestDeadline,
+	ErrBinaryBody,
+	ErrNoResources,
+	ErrNotSuccess,
+	context.DeadlineExceeded,
+	context.Canceled,
+}
+
+// errorClass returns description of error without details (ex: paths or output): exit status of script, message of
+// known error or "internal error".
+func errorClass(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return "exit status " + strconv.Itoa(code)
+		}
+		return "terminated by signal"
+	}
+	for _, known := range knownErrors {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "internal error"
+}
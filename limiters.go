@@ -1,14 +1,23 @@
 package wd
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"math"
 	"net/http"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
 )
 
 // ErrTooBigRequest used to indicate that stream is bigger than allowed.
 var ErrTooBigRequest = errors.New("request payload is too big")
 
+// ErrTooBigResponse used to indicate that script output is bigger than allowed.
+var ErrTooBigResponse = errors.New("response is too big")
+
 // RequestSizeLimit checks Content-Length (if applicable) to prevent consume request body bigger than allowed;
 // the 413 Request Entity Too Large will be automatically returned without passing the request to the handler.
 //
@@ -30,6 +39,95 @@ func RequestSizeLimit(maxSize int64, handler http.Handler) http.Handler {
 	})
 }
 
+// RequireBody rejects requests without body to paths matched by patterns (see PathPatterns for syntax, ex:
+// /user/:id); empty patterns means all paths. Requests without Content-Length and not chunked are rejected with 411
+// Length Required, requests with zero Content-Length or empty chunked body - with 400 Bad Request, so scripts which
+// require data are not invoked with empty input. Complements RequestSizeLimit with a lower bound.
+func RequireBody(patterns []string, handler http.Handler) http.Handler {
+	var parsed = make([][]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		parsed = append(parsed, pathSegments(pattern))
+	}
+	isRequired := func(path string) bool {
+		if len(parsed) == 0 {
+			return true
+		}
+		segments := pathSegments(path)
+		for _, pattern := range parsed {
+			if matchSegments(pattern, segments) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !isRequired(request.URL.Path) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		if request.ContentLength == 0 && request.Header.Get("Content-Length") == "" {
+			http.Error(writer, http.StatusText(http.StatusLengthRequired), http.StatusLengthRequired)
+			return
+		}
+		if request.ContentLength == 0 {
+			http.Error(writer, "request body required", http.StatusBadRequest)
+			return
+		}
+		if request.ContentLength < 0 {
+			// chunked body could be empty as well
+			var probe [1]byte
+			n, err := io.ReadFull(request.Body, probe[:])
+			if n == 0 {
+				if err == io.EOF {
+					err = errors.New("request body required")
+				}
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			request.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(probe[:n]), request.Body), Closer: request.Body}
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// prefixedBody is request body with already consumed prefix.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// ConcurrencyLimitPerKey limits number of in-flight requests with the same key (ex: authenticated subject) to prevent
+// monopolizing service by single client; the 429 Too Many Requests will be returned once limit exceeded. Requests with
+// empty key share the same limit. Zero or negative limit means unlimited.
+func ConcurrencyLimitPerKey(limit int64, key func(request *http.Request) string, handler http.Handler) http.Handler {
+	if limit <= 0 {
+		return handler
+	}
+	var lock sync.Mutex
+	var active = make(map[string]int64)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		k := key(request)
+		lock.Lock()
+		if active[k] >= limit {
+			lock.Unlock()
+			http.Error(writer, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		active[k]++
+		lock.Unlock()
+
+		defer func() {
+			lock.Lock()
+			defer lock.Unlock()
+			active[k]--
+			if active[k] == 0 {
+				delete(active, k)
+			}
+		}()
+		handler.ServeHTTP(writer, request)
+	})
+}
+
 type sizeLimiter struct {
 	maxSize  int64
 	consumed int64
@@ -39,12 +137,19 @@ type sizeLimiter struct {
 
 func (sl *sizeLimiter) Read(p []byte) (n int, err error) {
 	if sl.err != nil {
-		return 0, err
+		return 0, sl.err
 	}
 	chunk := int64(len(p))
 	left := sl.maxSize - sl.consumed
 	if left <= 0 {
-		sl.err = ErrTooBigRequest
+		// stream could be exactly the maximum size, so make sure there is something left
+		var probe [1]byte
+		n, err = sl.reader.Read(probe[:])
+		if n > 0 {
+			sl.err = ErrTooBigRequest
+		} else {
+			sl.err = err
+		}
 		return 0, sl.err
 	}
 	if left < chunk {
@@ -59,3 +164,150 @@ func (sl *sizeLimiter) Read(p []byte) (n int, err error) {
 func (sl *sizeLimiter) Close() error {
 	return sl.reader.Close()
 }
+
+// responseLimiter passes data to writer till limit reached. Once the limit exceeded, abort function will be
+// called and ErrTooBigResponse returned for all consequent writes.
+type responseLimiter struct {
+	maxSize  int64
+	written  int64
+	exceeded bool
+	abort    func()
+	writer   io.Writer
+}
+
+func (rl *responseLimiter) Write(p []byte) (int, error) {
+	if rl.exceeded {
+		return 0, ErrTooBigResponse
+	}
+	left := rl.maxSize - rl.written
+	if int64(len(p)) > left {
+		rl.exceeded = true
+		rl.abort()
+		n, err := rl.writer.Write(p[:left])
+		rl.written += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, ErrTooBigResponse
+	}
+	n, err := rl.writer.Write(p)
+	rl.written += int64(n)
+	return n, err
+}
+
+// Exceeded returns true if limit has been reached.
+func (rl *responseLimiter) Exceeded() bool {
+	return rl.exceeded
+}
+
+// pathLimiter limits number of parallel requests per path. Semaphores created lazily and removed once not used.
+type pathLimiter struct {
+	defaultLimit int64
+	limits       map[string]int64
+	lock         sync.Mutex
+	active       map[string]*pathSemaphore
+}
+
+type pathSemaphore struct {
+	users     int
+	semaphore *semaphore.Weighted
+}
+
+func newPathLimiter(defaultLimit int64, limits map[string]int64) *pathLimiter {
+	return &pathLimiter{
+		defaultLimit: defaultLimit,
+		limits:       limits,
+		active:       make(map[string]*pathSemaphore),
+	}
+}
+
+// Acquire slot for path. Blocks till slot available or context canceled. Returned function must be called to
+// release slot in case of no errors.
+func (pl *pathLimiter) Acquire(ctx context.Context, path string) (func(), error) {
+	limit, ok := pl.limits[path]
+	if !ok {
+		limit = pl.defaultLimit
+	}
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	pl.lock.Lock()
+	sem, ok := pl.active[path]
+	if !ok {
+		sem = &pathSemaphore{semaphore: semaphore.NewWeighted(limit)}
+		pl.active[path] = sem
+	}
+	sem.users++
+	pl.lock.Unlock()
+
+	if err := sem.semaphore.Acquire(ctx, 1); err != nil {
+		pl.done(path, sem)
+		return nil, err
+	}
+	return func() {
+		sem.semaphore.Release(1)
+		pl.done(path, sem)
+	}, nil
+}
+
+func (pl *pathLimiter) done(path string, sem *pathSemaphore) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	sem.users--
+	if sem.users == 0 {
+		delete(pl.active, path)
+	}
+}
+
+const (
+	retryBudgetReserve = 10  // retries available for path before any successes
+	retryBudgetMax     = 100 // maximum accumulated retries for path
+)
+
+// retryBudget limits number of async retries per path relative to number of successful async requests (see
+// Config.RetryBudget). Each success deposits ratio of retry, each retry withdraws one.
+type retryBudget struct {
+	ratio   float64
+	lock    sync.Mutex
+	balance map[string]float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+	return &retryBudget{ratio: ratio, balance: make(map[string]float64)}
+}
+
+// Deposit successful request for path. Nil budget is noop.
+func (rb *retryBudget) Deposit(path string) {
+	if rb == nil {
+		return
+	}
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	balance, ok := rb.balance[path]
+	if !ok {
+		balance = retryBudgetReserve
+	}
+	rb.balance[path] = math.Min(balance+rb.ratio, retryBudgetMax)
+}
+
+// Withdraw one retry for path. Returns false if budget exhausted. Nil budget always allows retry.
+func (rb *retryBudget) Withdraw(path string) bool {
+	if rb == nil {
+		return true
+	}
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	balance, ok := rb.balance[path]
+	if !ok {
+		balance = retryBudgetReserve
+	}
+	if balance < 1 {
+		return false
+	}
+	rb.balance[path] = balance - 1
+	return true
+}
@@ -0,0 +1,157 @@
+package wd_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/reddec/wd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSizeLimit(t *testing.T) {
+	t.Run("chunked body past limit", func(t *testing.T) {
+		var readErrs []error
+		handler := wd.RequestSizeLimit(5, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			_, err := ioutil.ReadAll(request.Body)
+			readErrs = append(readErrs, err)
+			for i := 0; i < 3; i++ {
+				_, err = request.Body.Read(make([]byte, 10))
+				readErrs = append(readErrs, err)
+			}
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1234567890"))
+		req.ContentLength = -1
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		require.Len(t, readErrs, 4)
+		for _, err := range readErrs {
+			assert.ErrorIs(t, err, wd.ErrTooBigRequest)
+		}
+	})
+
+	t.Run("chunked body exactly limit", func(t *testing.T) {
+		handler := wd.RequestSizeLimit(5, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			data, err := ioutil.ReadAll(request.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "12345", string(data))
+			_, err = request.Body.Read(make([]byte, 10))
+			assert.ErrorIs(t, err, io.EOF)
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("12345"))
+		req.ContentLength = -1
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	t.Run("webhook replies 413", func(t *testing.T) {
+		for _, argType := range []wd.ArgType{wd.ArgTypeStdin, wd.ArgTypeEnv} {
+			handler := wd.RequestSizeLimit(5, wd.New(wd.Config{BufferSize: 1024, ArgType: argType}, wd.StaticScript("cat")))
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1234567890"))
+			req.ContentLength = -1
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+		}
+	})
+}
+
+func TestConcurrencyLimitPerKey(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := wd.ConcurrencyLimitPerKey(1, func(request *http.Request) string {
+		return request.Header.Get("X-Subject")
+	}, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+
+	call := func(path, subject string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Subject", subject)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- call("/slow", "alice") }()
+	<-started
+
+	assert.Equal(t, http.StatusTooManyRequests, call("/", "alice"))
+	assert.Equal(t, http.StatusOK, call("/", "bob"))
+	assert.Equal(t, http.StatusOK, call("/", ""))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, call("/", "alice"))
+}
+
+func TestMaxCachedBody(t *testing.T) {
+	for _, argType := range []wd.ArgType{wd.ArgTypeParam, wd.ArgTypeEnv} {
+		wh := wd.New(wd.Config{ArgType: argType, MaxCachedBody: 5}, wd.StaticScript("true"))
+
+		for _, contentLength := range []int64{10, -1} {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1234567890"))
+			req.ContentLength = contentLength
+			res := httptest.NewRecorder()
+			wh.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code, "content length %d", contentLength)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("12345"))
+		req.ContentLength = -1
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	}
+
+	// not applicable for streaming arg types
+	wh := wd.New(wd.Config{MaxCachedBody: 5}, wd.StaticScript("cat"))
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1234567890")))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "1234567890", res.Body.String())
+}
+
+func TestRequireBody(t *testing.T) {
+	handler := wd.RequireBody([]string{"/deploy", "/user/:id"}, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.Copy(writer, request.Body)
+	}))
+
+	send := func(path string, body string, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.ContentLength = contentLength
+		if contentLength >= 0 {
+			req.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send("/deploy", "data", 4)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "data", res.Body.String())
+
+	res = send("/user/1", "data", -1)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "data", res.Body.String(), "chunked body passed as-is")
+
+	assert.Equal(t, http.StatusBadRequest, send("/deploy", "", 0).Code)
+	assert.Equal(t, http.StatusBadRequest, send("/deploy", "", -1).Code, "empty chunked body")
+	assert.Equal(t, http.StatusOK, send("/other", "", 0).Code, "not required")
+
+	req := httptest.NewRequest(http.MethodPost, "/deploy", nil)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusLengthRequired, res.Code)
+}
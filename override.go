@@ -0,0 +1,76 @@
+package wd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// ManifestHeader contains JSON encoded ManifestOverride. Honored only if Config.ManifestSecrets defined and
+	// ManifestSignatureHeader contains valid signature of header value.
+	ManifestHeader = "X-WD-Manifest"
+	// ManifestSignatureHeader contains HMAC-SHA256 signature (hex encoded) of ManifestHeader value. See SignManifest.
+	ManifestSignatureHeader = "X-WD-Manifest-Signature"
+)
+
+// ManifestOverride is per-request override of default manifest for trusted callers. Zero fields are ignored. Script
+// specific settings (ex: xattrs) still take precedence.
+//
+//	{"async": "forced", "timeout": "30s", "retries": 3, "delay": "5s"}
+type ManifestOverride struct {
+	Async   AsyncMode `json:"async"`
+	Timeout duration  `json:"timeout"`
+	Retries uint      `json:"retries"`
+	Delay   duration  `json:"delay"`
+}
+
+// SignManifest returns signature of ManifestHeader value for ManifestSignatureHeader.
+func SignManifest(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestManifest returns default manifest merged with override from ManifestHeader. Override without valid signature
+// is ignored.
+func (wh *Webhooks) requestManifest(req *http.Request) Manifest {
+	manifest := wh.defaultManifest()
+	value := req.Header.Get(ManifestHeader)
+	if value == "" || len(wh.config.ManifestSecrets) == 0 {
+		return manifest
+	}
+	if !wh.isManifestSigned(value, req.Header.Get(ManifestSignatureHeader)) {
+		wh.config.Logger.Warn("manifest override ignored: invalid signature", "path", req.URL.Path)
+		return manifest
+	}
+	var override ManifestOverride
+	if err := json.Unmarshal([]byte(value), &override); err != nil {
+		wh.config.Logger.Warn("manifest override ignored: invalid JSON", "path", req.URL.Path, "error", err)
+		return manifest
+	}
+	manifest.Merge(Manifest{
+		Async:   override.Async,
+		Timeout: time.Duration(override.Timeout),
+		Retries: override.Retries,
+		Delay:   time.Duration(override.Delay),
+	})
+	return manifest
+}
+
+func (wh *Webhooks) isManifestSigned(value string, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	for _, secret := range wh.config.ManifestSecrets {
+		expected, _ := hex.DecodeString(SignManifest(secret, value))
+		if hmac.Equal(expected, sig) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,15 +3,49 @@ package wd
 import (
 	"container/list"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
 	"sync"
+	"time"
 )
 
 type QueuedWebhook struct {
 	RequestFile string
+	Path        string // request path
 	Manifest    *Manifest
+	RemoteAddr  string // address of client (http.Request.RemoteAddr), not preserved by request serialization
+	TLS         bool   // request received over TLS
+	TaskID      string // ID of task (see Config.Tasks). Empty if tasks are not tracked
+	ClientCert  []byte // DER encoded verified client certificate (mutual TLS)
+	// time when item pushed to queue. Zero for items pushed by previous versions
+	Enqueued time.Time
+}
+
+// restore connection information (client address and TLS) of original request.
+func (qw *QueuedWebhook) restore(req *http.Request) error {
+	req.RemoteAddr = qw.RemoteAddr
+	if !qw.TLS {
+		return nil
+	}
+	req.TLS = &tls.ConnectionState{HandshakeComplete: true}
+	if len(qw.ClientCert) > 0 {
+		cert, err := x509.ParseCertificate(qw.ClientCert)
+		if err != nil {
+			return fmt.Errorf("parse client certificate: %w", err)
+		}
+		// certificate has been verified on arrival
+		req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return nil
 }
 
 // Queue for storing values for async processing.
+//
+// Queue may report enqueue time (QueuedWebhook.Enqueued) of the oldest item by Oldest(context.Context) (time.Time, error)
+// method, which returns zero time for empty queue. It's used for webhooks_queue_oldest_age_seconds metric.
 type Queue interface {
 	// Push value to queue to the back.
 	Push(ctx context.Context, manifest *QueuedWebhook) error
@@ -66,20 +100,38 @@ func (q *inMemory) Pop(ctx context.Context) (*QueuedWebhook, error) {
 	}
 }
 
+// Oldest returns enqueue time of the first item or zero time if queue is empty.
+func (q *inMemory) Oldest(context.Context) (time.Time, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if elem := q.content.Front(); elem != nil {
+		return elem.Value.(*QueuedWebhook).Enqueued, nil
+	}
+	return time.Time{}, nil
+}
+
 // Limited in-memory queue with predefined maximum size
 func Limited(size int) Queue {
-	return &boundQueue{queue: make(chan *QueuedWebhook, size)}
+	return &boundQueue{queue: make(chan *QueuedWebhook, size), enqueued: list.New()}
 }
 
 type boundQueue struct {
-	queue chan *QueuedWebhook
+	queue    chan *QueuedWebhook
+	lock     sync.Mutex
+	enqueued *list.List // enqueue times of items in channel (approximate order for concurrent pushes)
 }
 
 func (q *boundQueue) Push(ctx context.Context, value *QueuedWebhook) error {
+	q.lock.Lock()
+	elem := q.enqueued.PushBack(value.Enqueued)
+	q.lock.Unlock()
 	select {
 	case q.queue <- value:
 		return nil
 	case <-ctx.Done():
+		q.lock.Lock()
+		q.enqueued.Remove(elem)
+		q.lock.Unlock()
 		return ctx.Err()
 	}
 }
@@ -87,8 +139,23 @@ func (q *boundQueue) Push(ctx context.Context, value *QueuedWebhook) error {
 func (q *boundQueue) Pop(ctx context.Context) (*QueuedWebhook, error) {
 	select {
 	case value := <-q.queue:
+		q.lock.Lock()
+		if elem := q.enqueued.Front(); elem != nil {
+			q.enqueued.Remove(elem)
+		}
+		q.lock.Unlock()
 		return value, nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
+
+// Oldest returns enqueue time of the first item or zero time if queue is empty.
+func (q *boundQueue) Oldest(context.Context) (time.Time, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if elem := q.enqueued.Front(); elem != nil {
+		return elem.Value.(time.Time), nil
+	}
+	return time.Time{}, nil
+}
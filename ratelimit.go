@@ -0,0 +1,160 @@
+package wd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidRateLimit = errors.New("rate limit should be in requests/period format (ex: 10/1m)")
+
+// rateLimitSweepInterval is minimal interval between removals of idle buckets by in-memory rate limiter.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is maximum number of requests per period with bursts up to Requests. Text representation is
+// requests/period, period unit without number means one unit (ex: 10/1m, 100/h, 5/s). Zero value means unlimited.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// IsZero returns true if rate is not limited.
+func (rl RateLimit) IsZero() bool {
+	return rl.Requests <= 0 || rl.Period <= 0
+}
+
+func (rl *RateLimit) UnmarshalText(data []byte) error {
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		*rl = RateLimit{}
+		return nil
+	}
+	requests, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return ErrInvalidRateLimit
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return ErrInvalidRateLimit
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return ErrInvalidRateLimit
+	}
+	*rl = RateLimit{Requests: n, Period: d}
+	return nil
+}
+
+func (rl RateLimit) MarshalText() ([]byte, error) {
+	return []byte(rl.String()), nil
+}
+
+func (rl RateLimit) String() string {
+	if rl.IsZero() {
+		return ""
+	}
+	return strconv.Itoa(rl.Requests) + "/" + rl.Period.String()
+}
+
+// RateLimiter checks rate limits of requests. Implementation should be safe for concurrent use.
+type RateLimiter interface {
+	// Allow request by key within limit. Returns zero if request allowed, otherwise time to wait before the next
+	// request will be allowed.
+	Allow(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+}
+
+// NewMemoryRateLimiter creates in-memory token bucket rate limiter. Idle buckets are removed periodically.
+func NewMemoryRateLimiter() RateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+type memoryRateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+// refill tokens according to elapsed time.
+func (tb *tokenBucket) refill(now time.Time) {
+	rate := float64(tb.limit.Requests) / float64(tb.limit.Period)
+	tb.tokens = math.Min(float64(tb.limit.Requests), tb.tokens+float64(now.Sub(tb.updated))*rate)
+	tb.updated = now
+}
+
+func (ml *memoryRateLimiter) Allow(_ context.Context, key string, limit RateLimit) (time.Duration, error) {
+	if limit.IsZero() {
+		return 0, nil
+	}
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	now := time.Now()
+	if now.Sub(ml.swept) >= rateLimitSweepInterval {
+		ml.sweep(now)
+	}
+	bucket, ok := ml.buckets[key]
+	if !ok || bucket.limit != limit {
+		bucket = &tokenBucket{tokens: float64(limit.Requests), updated: now, limit: limit}
+		ml.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, nil
+	}
+	rate := float64(limit.Requests) / float64(limit.Period)
+	return time.Duration(math.Ceil((1 - bucket.tokens) / rate)), nil
+}
+
+// sweep removes full (idle) buckets.
+func (ml *memoryRateLimiter) sweep(now time.Time) {
+	ml.swept = now
+	for key, bucket := range ml.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Requests) {
+			delete(ml.buckets, key)
+		}
+	}
+}
+
+// checkRateLimit checks rate limit of script (see Manifest.RateLimit). Returns false if response already written:
+// 429 Too Many Requests with Retry-After header. Limiter errors are only logged and request processed as usual.
+func (wh *Webhooks) checkRateLimit(writer http.ResponseWriter, req *http.Request, manifest *Manifest) bool {
+	if manifest.RateLimit.IsZero() || wh.isDebugRequest(req) {
+		return true
+	}
+	key := req.URL.Path
+	if wh.config.RateLimitPerClient {
+		key += " " + wh.clientIP(req)
+	}
+	if wh.config.RateLimitKey != nil {
+		key += " " + wh.config.RateLimitKey(req)
+	}
+	wait, err := wh.config.RateLimiter.Allow(req.Context(), key, manifest.RateLimit)
+	if err != nil {
+		wh.config.Logger.Warn("failed check rate limit", "path", req.URL.Path, "error", err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+	wh.rateLimited.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+	wh.config.Logger.Debug("request rate limited", "path", req.URL.Path, "limit", manifest.RateLimit, "retry_after", wait)
+	writer.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	http.Error(writer, fmt.Sprintf("rate limit %s exceeded", manifest.RateLimit), http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,101 @@
+package wd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisPopTimeout is maximum time for single BRPOP, so context cancellation checked at least each interval.
+const redisPopTimeout = time.Second
+
+// RedisQueue creates queue backed by Redis list, which can be shared between several instances. Items serialized
+// as JSON, pushed by LPUSH and popped by BRPOP.
+//
+// Serialized requests are not stored in Redis, so QueuedWebhook.RequestFile must be accessible by all instances:
+// Config.QueueDir should point to shared storage (ex: NFS).
+//
+// Redis errors and malformed items are logged by logger (nil means slog.Default()): failed pops are retried,
+// malformed items are skipped.
+//
+// Queue supports health checks (see Webhooks.PingQueue). Webhooks.Pending and queue size metric are not tracked
+// for the queue, since items could be pushed and popped by different instances.
+func RedisQueue(client redis.UniversalClient, key string, logger *slog.Logger) Queue {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &redisQueue{client: client, key: key, logger: logger}
+}
+
+type redisQueue struct {
+	client redis.UniversalClient
+	key    string
+	logger *slog.Logger
+}
+
+func (q *redisQueue) Push(ctx context.Context, value *QueuedWebhook) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("serialize item: %w", err)
+	}
+	return q.client.LPush(ctx, q.key, data).Err()
+}
+
+// Shared always returns true: items pushed by one instance may be popped by another.
+func (q *redisQueue) Shared() bool {
+	return true
+}
+
+// Ping checks that Redis is reachable.
+func (q *redisQueue) Ping(ctx context.Context) error {
+	return q.client.Ping(ctx).Err()
+}
+
+// Oldest returns enqueue time of the first item (the last in Redis list) or zero time if queue is empty.
+func (q *redisQueue) Oldest(ctx context.Context) (time.Time, error) {
+	data, err := q.client.LIndex(ctx, q.key, -1).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	var item QueuedWebhook
+	if err := json.Unmarshal(data, &item); err != nil {
+		return time.Time{}, fmt.Errorf("parse item: %w", err)
+	}
+	return item.Enqueued, nil
+}
+
+func (q *redisQueue) Pop(ctx context.Context) (*QueuedWebhook, error) {
+	for {
+		res, err := q.client.BRPop(ctx, redisPopTimeout, q.key).Result()
+		// item is already removed from Redis, so it should be returned even if context just canceled
+		if err == nil {
+			// result is key and value
+			var item QueuedWebhook
+			if err := json.Unmarshal([]byte(res[1]), &item); err != nil {
+				q.logger.Error("failed parse item from redis", "key", q.key, "error", err)
+				continue
+			}
+			return &item, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		q.logger.Error("failed pop item from redis", "key", q.key, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(redisPopTimeout):
+		}
+	}
+}
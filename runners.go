@@ -1,19 +1,42 @@
 package wd
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/reddec/wd/internal"
+	"gopkg.in/yaml.v3"
 )
 
 type Manifest struct {
-	Command []string
-	Async   AsyncMode
-	Timeout time.Duration
-	Retries uint
-	Delay   time.Duration
+	Command     []string
+	Async       AsyncMode
+	Timeout     time.Duration
+	Retries     uint
+	Delay       time.Duration
+	MaxResponse int64    // maximum size of script output in bytes. Zero or negative means unlimited
+	Methods     []string // allowed HTTP methods. Empty means all methods allowed
+	WorkDir     string   // script specific work dir. Disables temp dirs. Empty means Config.WorkDir or temp dir
+	Query       []string // allowed query params in addition to Config.AllowedQuery (see Config.StrictQuery)
+	Nice        int      // (Linux only) niceness of script. Zero means inherited
+	IOClass     IOClass  // (Linux only) IO scheduling class of script
+	Env         []string // additional environment variables (KEY=VALUE). Can override variables from headers and query
+	Callback    string   // URL for completion callback of async requests (see Config.CompletionCallback)
+	Backoff     BackoffStrategy
+	RateLimit   RateLimit // maximum rate of requests to script (see Config.RateLimit)
 }
 
 func (m *Manifest) Binary() string {
@@ -24,6 +47,68 @@ func (m *Manifest) Args() []string {
 	return m.Command[1:]
 }
 
+// Merge non-zero fields from override to the manifest.
+func (m *Manifest) Merge(override Manifest) {
+	if len(override.Command) > 0 {
+		m.Command = override.Command
+	}
+	if override.Async != AsyncModeAuto {
+		m.Async = override.Async
+	}
+	if override.Timeout != 0 {
+		m.Timeout = override.Timeout
+	}
+	if override.Retries != 0 {
+		m.Retries = override.Retries
+	}
+	if override.Delay != 0 {
+		m.Delay = override.Delay
+	}
+	if override.MaxResponse != 0 {
+		m.MaxResponse = override.MaxResponse
+	}
+	if len(override.Methods) > 0 {
+		m.Methods = override.Methods
+	}
+	if override.WorkDir != "" {
+		m.WorkDir = override.WorkDir
+	}
+	if len(override.Query) > 0 {
+		m.Query = override.Query
+	}
+	if override.Nice != 0 {
+		m.Nice = override.Nice
+	}
+	if override.IOClass != IOClassDefault {
+		m.IOClass = override.IOClass
+	}
+	if override.Callback != "" {
+		m.Callback = override.Callback
+	}
+	if len(override.Env) > 0 {
+		m.Env = override.Env
+	}
+	if override.Backoff.Kind != BackoffDefault {
+		m.Backoff = override.Backoff
+	}
+	if !override.RateLimit.IsZero() {
+		m.RateLimit = override.RateLimit
+	}
+}
+
+// IsMethodAllowed checks that request method allowed for the script.
+func (m *Manifest) IsMethodAllowed(method string) bool {
+	if len(m.Methods) == 0 {
+		return true
+	}
+	for _, allowed := range m.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
 type Runner interface {
 	// Command to execute. Returns nil if not applicable. Default manifest should be used as base.
 	Command(req *http.Request, defaultManifest Manifest) *Manifest
@@ -43,50 +128,142 @@ func StaticScript(command string, args ...string) RunnerFunc {
 	}
 }
 
+// StaticScriptEnv is StaticScript with fixed environment variables for script (see Manifest.Env).
+func StaticScriptEnv(env map[string]string, command string, args ...string) RunnerFunc {
+	vars := make([]string, 0, len(env))
+	for k, v := range env {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	script := StaticScript(command, args...)
+	return func(req *http.Request, d Manifest) *Manifest {
+		manifest := script(req, d)
+		manifest.Env = vars
+		return manifest
+	}
+}
+
 const (
 	AttrAsync   = "user.webhook.async"   // auto|disabled|forced, forces async execution for script
 	AttrTimeout = "user.webhook.timeout" // duration, maximum execution time
 	AttrDelay   = "user.webhook.delay"   // duration, interval between attempts
 	AttrRetries = "user.webhook.retries" // int64, maximum number of additional attempts
+
+	AttrMaxResponse = "user.webhook.max_response" // int64, maximum size of output in bytes
+	AttrWorkDir     = "user.webhook.workdir"      // string, work dir for script
+	AttrQuery       = "user.webhook.query"        // comma-separated list of allowed query params (see Config.StrictQuery)
+	AttrMethods     = "user.webhook.methods"      // comma-separated list of allowed HTTP methods
+	AttrNice        = "user.webhook.nice"         // int, niceness of script (Linux only)
+	AttrIOClass     = "user.webhook.ioclass"      // default|realtime|best-effort|idle, IO scheduling class (Linux only)
+	AttrCallback    = "user.webhook.callback"     // URL, completion callback for async requests
+	AttrBackoff     = "user.webhook.backoff"      // constant|exponential[,multiplier=N][,max=duration][,jitter], see BackoffStrategy
+	AttrRateLimit   = "user.webhook.ratelimit"    // requests/period (ex: 10/1m), see RateLimit
 )
 
 type DirectoryRunner struct {
 	AllowDotFiles bool   // allows run scripts with leading dot in names
 	ScriptsDir    string // path to directory with scripts. MUST be absolute
+	IndexFile     string // script name (ex: index.sh) used for requests to directories. Empty means directories are not served
 }
 
 func (dr *DirectoryRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
 	absScriptPath, err := filepath.Abs(filepath.Join(dr.ScriptsDir, req.URL.Path))
 	if err != nil {
-		log.Println("failed detect absolute path:", err)
+		slog.Error("failed detect absolute path", "path", req.URL.Path, "error", err)
 		return nil
 	}
 
-	if !strings.HasPrefix(absScriptPath, dr.ScriptsDir+string(filepath.Separator)) {
-		log.Println("attempt to reach file outside of script dir:", absScriptPath)
-		return nil
+	if dr.IndexFile != "" && absScriptPath == dr.ScriptsDir {
+		absScriptPath = filepath.Join(absScriptPath, dr.IndexFile)
 	}
 
-	if !dr.isPathAllowed(absScriptPath) {
-		log.Println("attempt to reach dot files:", absScriptPath)
+	if !dr.isScriptAllowed(req.URL.Path, absScriptPath) {
 		return nil
 	}
 
+	if info, err := os.Stat(absScriptPath); err == nil && info.IsDir() {
+		if dr.IndexFile == "" {
+			slog.Warn("attempt to run directory", "path", req.URL.Path, "script", absScriptPath)
+			return nil
+		}
+		absScriptPath = filepath.Join(absScriptPath, dr.IndexFile)
+		if !dr.isScriptAllowed(req.URL.Path, absScriptPath) {
+			return nil
+		}
+		if info, err := os.Stat(absScriptPath); err != nil || info.IsDir() {
+			slog.Debug("index script not found", "path", req.URL.Path, "script", absScriptPath)
+			return nil
+		}
+	}
+
 	defaultManifest.Command = []string{absScriptPath}
 	if err := readAttrs(absScriptPath, &defaultManifest); err != nil {
-		log.Println("failed read x-attrs:", err)
+		slog.Warn("failed read x-attrs", "path", req.URL.Path, "script", absScriptPath, "error", err)
 	}
 
 	return &defaultManifest
 }
 
+// Validate all scripts in directory which can be executed by runner: scripts should be executable, have existing
+// interpreter in shebang line (if any) and valid script specific parameters (xattrs). Returns list of found problems.
+func (dr *DirectoryRunner) Validate() []error {
+	var problems []error
+	err := filepath.Walk(dr.ScriptsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", path, err))
+			return nil
+		}
+		if path == dr.ScriptsDir {
+			return nil
+		}
+		if !dr.isPathAllowed(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !internal.IsExecutable(path) {
+			problems = append(problems, fmt.Errorf("%s: not executable", path))
+		}
+		if err := internal.CheckShebang(path); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", path, err))
+		}
+		var manifest Manifest
+		if err := readAttrs(path, &manifest); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", path, err))
+		}
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, fmt.Errorf("walk %s: %w", dr.ScriptsDir, err))
+	}
+	return problems
+}
+
+// isScriptAllowed checks that script is inside scripts dir and not hidden (if dot files are not allowed).
+func (dr *DirectoryRunner) isScriptAllowed(path string, absScriptPath string) bool {
+	if !strings.HasPrefix(absScriptPath, dr.ScriptsDir+string(filepath.Separator)) {
+		slog.Warn("attempt to reach file outside of script dir", "path", path, "script", absScriptPath)
+		return false
+	}
+
+	if !dr.isPathAllowed(absScriptPath) {
+		slog.Warn("attempt to reach dot files", "path", path, "script", absScriptPath)
+		return false
+	}
+	return true
+}
+
 func (dr *DirectoryRunner) isPathAllowed(scriptPath string) bool {
 	if dr.AllowDotFiles {
 		return true
 	}
 	relPath, err := filepath.Rel(dr.ScriptsDir, scriptPath)
 	if err != nil {
-		log.Println("detect relative path:", err)
+		slog.Error("detect relative path", "script", scriptPath, "error", err)
 		return false
 	}
 
@@ -97,3 +274,305 @@ func (dr *DirectoryRunner) isPathAllowed(scriptPath string) bool {
 	}
 	return true
 }
+
+// MapRunner routes requests to pre-defined commands by exact match of request path.
+type MapRunner struct {
+	Routes map[string]Manifest // request path (ex: /deploy) -> manifest. Non-zero fields overrides default manifest
+}
+
+// NewMapRunner creates runner based on routes: request path (ex: /deploy) -> manifest.
+func NewMapRunner(routes map[string]Manifest) *MapRunner {
+	return &MapRunner{Routes: routes}
+}
+
+// LoadMapRunner loads routes from JSON or YAML (detected by .yaml or .yml extension) file. Format is:
+//
+//	/deploy:
+//	  command: ["/usr/local/bin/deploy", "--all"]
+//	  async: forced
+//	  timeout: 5m
+//	  retries: 3
+//	  delay: 10s
+//	  max_response: 1048576
+//	  methods: [POST, PUT]
+//	  work_dir: /srv/app
+//	  query: [env, version]
+//	  nice: 10
+//	  io_class: idle
+//	  backoff: exponential,max=5m
+//	  callback: https://example.com/done
+//	  ratelimit: 10/1m
+func LoadMapRunner(path string) (*MapRunner, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routes: %w", err)
+	}
+	var routes map[string]routeDefinition
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &routes)
+	default:
+		err = json.Unmarshal(data, &routes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse routes %s: %w", path, err)
+	}
+
+	var manifests = make(map[string]Manifest, len(routes))
+	for path, route := range routes {
+		if len(route.Command) == 0 {
+			return nil, fmt.Errorf("route %s: command not defined", path)
+		}
+		manifests[path] = route.Manifest()
+	}
+	return NewMapRunner(manifests), nil
+}
+
+func (mr *MapRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	route, ok := mr.Routes[req.URL.Path]
+	if !ok || len(route.Command) == 0 {
+		return nil
+	}
+	defaultManifest.Merge(route)
+	return &defaultManifest
+}
+
+type routeDefinition struct {
+	Command []string  `json:"command" yaml:"command"`
+	Async   AsyncMode `json:"async" yaml:"async"`
+	Timeout duration  `json:"timeout" yaml:"timeout"`
+	Retries uint      `json:"retries" yaml:"retries"`
+	Delay   duration  `json:"delay" yaml:"delay"`
+
+	MaxResponse int64    `json:"max_response" yaml:"max_response"`
+	Methods     []string `json:"methods" yaml:"methods"`
+	WorkDir     string   `json:"work_dir" yaml:"work_dir"`
+	Query       []string `json:"query" yaml:"query"`
+	Nice        int      `json:"nice" yaml:"nice"`
+	IOClass     IOClass  `json:"io_class" yaml:"io_class"`
+
+	Backoff   BackoffStrategy `json:"backoff" yaml:"backoff"`
+	Callback  string          `json:"callback" yaml:"callback"`
+	RateLimit RateLimit       `json:"ratelimit" yaml:"ratelimit"`
+}
+
+func (rd *routeDefinition) Manifest() Manifest {
+	return Manifest{
+		Command: rd.Command,
+		Async:   rd.Async,
+		Timeout: time.Duration(rd.Timeout),
+		Retries: rd.Retries,
+		Delay:   time.Duration(rd.Delay),
+
+		MaxResponse: rd.MaxResponse,
+		Methods:     rd.Methods,
+		WorkDir:     rd.WorkDir,
+		Query:       rd.Query,
+		Nice:        rd.Nice,
+		IOClass:     rd.IOClass,
+		Backoff:     rd.Backoff,
+		Callback:    rd.Callback,
+		RateLimit:   rd.RateLimit,
+	}
+}
+
+// duration in Golang representation (ex: 1m30s).
+type duration time.Duration
+
+func (d *duration) UnmarshalText(data []byte) error {
+	v, err := time.ParseDuration(string(data))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// ConfigRunner serves routes from file (see LoadMapRunner) and supports reloading.
+type ConfigRunner struct {
+	file   string
+	lock   sync.RWMutex
+	runner *MapRunner
+}
+
+// NewConfigRunner loads routes from file. See LoadMapRunner for format.
+func NewConfigRunner(file string) (*ConfigRunner, error) {
+	runner, err := LoadMapRunner(file)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigRunner{file: file, runner: runner}, nil
+}
+
+// Reload routes from file. In case of error, previous routes will be kept.
+func (cr *ConfigRunner) Reload() error {
+	runner, err := LoadMapRunner(cr.file)
+	if err != nil {
+		return err
+	}
+	cr.lock.Lock()
+	cr.runner = runner
+	cr.lock.Unlock()
+	return nil
+}
+
+func (cr *ConfigRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	cr.lock.RLock()
+	runner := cr.runner
+	cr.lock.RUnlock()
+	return runner.Command(req, defaultManifest)
+}
+
+// RewriteRule replaces request path matched by Pattern to Replacement (see regexp.Regexp.ReplaceAllString).
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRewriteRule parses rule in pattern=replacement format (ex: ^/deploy$=/v2/deploy.sh).
+func ParseRewriteRule(rule string) (RewriteRule, error) {
+	pattern, replacement, ok := strings.Cut(rule, "=")
+	if !ok || pattern == "" {
+		return RewriteRule{}, fmt.Errorf("rewrite rule should be in pattern=replacement format: %s", rule)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return RewriteRule{}, fmt.Errorf("parse rewrite pattern %s: %w", pattern, err)
+	}
+	return RewriteRule{Pattern: re, Replacement: replacement}, nil
+}
+
+// RewriteRunner rewrites request path by the first matched rule before passing request to the wrapped runner. Only
+// lookup is affected: original path is used for everything else (REQUEST_PATH, metrics, etc.). Wrapped runner
+// is responsible for validating the rewritten path (ex: DirectoryRunner does not allow paths outside ScriptsDir).
+type RewriteRunner struct {
+	Rules  []RewriteRule
+	Runner Runner
+}
+
+func (rr *RewriteRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	for _, rule := range rr.Rules {
+		if !rule.Pattern.MatchString(req.URL.Path) {
+			continue
+		}
+		rewritten := *req
+		u := *req.URL
+		u.Path = rule.Pattern.ReplaceAllString(req.URL.Path, rule.Replacement)
+		u.RawPath = ""
+		rewritten.URL = &u
+		return rr.Runner.Command(&rewritten, defaultManifest)
+	}
+	return rr.Runner.Command(req, defaultManifest)
+}
+
+// HostRouter routes requests to runners by host (virtual hosts). Port is ignored, host is case-insensitive. Requests
+// for unknown hosts are routed to Default runner (if defined).
+type HostRouter struct {
+	Hosts   map[string]Runner // host (ex: a.example.com) -> runner. Keys should be in lower case
+	Default Runner            // runner for unknown hosts. Optional
+}
+
+func (hr *HostRouter) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if runner, ok := hr.Hosts[strings.ToLower(host)]; ok {
+		return runner.Command(req, defaultManifest)
+	}
+	if hr.Default == nil {
+		return nil
+	}
+	return hr.Default.Command(req, defaultManifest)
+}
+
+// HeaderRouter appends value of request header as the last path segment before passing request to the wrapped
+// runner (ex: /github with X-GitHub-Event: push is looked up as /github/push). Useful for providers which send all
+// events to a single URL. Requests without the header are passed as-is. Values which are not a single path segment
+// (ex: contain slashes or dot segments) are rejected (not found). Like for RewriteRunner, only lookup is affected.
+type HeaderRouter struct {
+	Header string // name of header (ex: X-Event-Type)
+	Runner Runner
+}
+
+func (hr *HeaderRouter) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	value := req.Header.Get(hr.Header)
+	if value == "" {
+		return hr.Runner.Command(req, defaultManifest)
+	}
+	if !isPathSegment(value) {
+		return nil
+	}
+	routed := *req
+	u := *req.URL
+	u.Path = strings.TrimSuffix(req.URL.Path, "/") + "/" + value
+	u.RawPath = ""
+	routed.URL = &u
+	return hr.Runner.Command(&routed, defaultManifest)
+}
+
+// isPathSegment returns true if value can be used as a single path segment without traversal.
+func isPathSegment(value string) bool {
+	return value != "." && value != ".." && !strings.ContainsAny(value, "/\\\x00")
+}
+
+// ContentTypeRunner routes requests to runners by media type of request (Content-Type header without parameters, ex:
+// application/json). Keys of Types are exact media types or glob patterns (ex: application/*, see path.Match). Exact
+// match has priority, otherwise the longest matched pattern is used. Requests with unmatched or without content type
+// are routed to Default runner (if defined).
+type ContentTypeRunner struct {
+	Types   map[string]Runner // media type or pattern (ex: application/json, text/*) -> runner. Keys should be in lower case
+	Default Runner            // runner for unmatched content types. Optional
+}
+
+func (cr *ContentTypeRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	if runner := cr.match(mediaType(req.Header.Get("Content-Type"))); runner != nil {
+		return runner.Command(req, defaultManifest)
+	}
+	if cr.Default == nil {
+		return nil
+	}
+	return cr.Default.Command(req, defaultManifest)
+}
+
+func (cr *ContentTypeRunner) match(contentType string) Runner {
+	if contentType == "" {
+		return nil
+	}
+	if runner, ok := cr.Types[contentType]; ok {
+		return runner
+	}
+	var best string
+	var found Runner
+	for pattern, runner := range cr.Types {
+		if ok, _ := path.Match(pattern, contentType); !ok {
+			continue
+		}
+		if found == nil || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best, found = pattern, runner
+		}
+	}
+	return found
+}
+
+// mediaType returns lower-cased media type without parameters (ex: "application/json; charset=utf-8" ->
+// "application/json").
+func mediaType(contentType string) string {
+	if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+		return parsed
+	}
+	parsed, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(parsed))
+}
+
+// MultiRunner returns manifest from the first runner which returned non-nil manifest.
+type MultiRunner []Runner
+
+func (mr MultiRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	for _, runner := range mr {
+		if manifest := runner.Command(req, defaultManifest); manifest != nil {
+			return manifest
+		}
+	}
+	return nil
+}
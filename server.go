@@ -0,0 +1,146 @@
+package wd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultAsyncWorkers is default number of async workers of Server.
+const DefaultAsyncWorkers = 2
+
+var ErrServerStarted = errors.New("server already started")
+
+// ServerConfig configures embeddable webhooks server (see NewServer).
+type ServerConfig struct {
+	Config                 // webhooks configuration. Starting is ignored: server is ready once started
+	Runner          Runner // resolves scripts for requests. Required
+	AsyncWorkers    int    // number of async workers. Zero means DefaultAsyncWorkers, negative - no workers
+	MetricsEndpoint string // path of Prometheus metrics endpoint (ex: /metrics). Empty means metrics are not exposed
+	HealthChecks    bool   // expose liveness (/healthz) and readiness (/readyz) endpoints
+	// wraps webhooks handler (ex: authorization). Auxiliary endpoints (metrics, health checks) are not wrapped
+	Middleware func(http.Handler) http.Handler
+}
+
+// Server bundles webhooks handler, async workers and auxiliary endpoints (metrics, health checks) for embedding
+// into other services. Low-level API (New and Run) can be used for advanced cases.
+type Server struct {
+	webhooks     *Webhooks
+	handler      http.Handler
+	asyncWorkers int
+	lock         sync.Mutex
+	started      bool
+	stopWorkers  context.CancelFunc
+	waitWorkers  func()
+}
+
+// NewServer creates server which is not ready to serve requests (503) till Start invoked. If Config.Registerer is not
+// defined, new registry is used. Registerer should implement prometheus.Gatherer (ex: prometheus.Registry) if
+// metrics exposed.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if cfg.Runner == nil {
+		return nil, errors.New("runner is not defined")
+	}
+	if cfg.AsyncWorkers == 0 {
+		cfg.AsyncWorkers = DefaultAsyncWorkers
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.NewRegistry()
+	}
+	cfg.Starting = true
+
+	srv := &Server{
+		webhooks:     New(cfg.Config, cfg.Runner),
+		asyncWorkers: cfg.AsyncWorkers,
+	}
+
+	var handler http.Handler = srv.webhooks
+	if cfg.Middleware != nil {
+		handler = cfg.Middleware(handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	if cfg.MetricsEndpoint != "" {
+		gatherer, ok := cfg.Registerer.(prometheus.Gatherer)
+		if !ok {
+			return nil, errors.New("metrics registerer does not implement prometheus.Gatherer")
+		}
+		mux.Handle(cfg.MetricsEndpoint, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	}
+	if cfg.HealthChecks {
+		mux.Handle("/healthz", Liveness())
+		mux.Handle("/readyz", Readiness(srv.webhooks))
+	}
+	srv.handler = mux
+	return srv, nil
+}
+
+// Handler returns HTTP handler with webhooks and auxiliary endpoints.
+func (srv *Server) Handler() http.Handler {
+	return srv.handler
+}
+
+// Webhooks returns underlying webhooks handler.
+func (srv *Server) Webhooks() *Webhooks {
+	return srv.webhooks
+}
+
+// Start async workers and mark server as ready. Workers are stopped once context canceled or Shutdown finished.
+// Server can be started only once.
+func (srv *Server) Start(ctx context.Context) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.started {
+		return ErrServerStarted
+	}
+	srv.started = true
+	ctx, srv.stopWorkers = context.WithCancel(ctx)
+	srv.waitWorkers = srv.webhooks.StartWorkers(ctx, srv.asyncWorkers)
+	srv.webhooks.MarkReady()
+	return nil
+}
+
+// Shutdown marks server as draining (new requests and readiness probe get 503, see Webhooks.MarkDraining), waits
+// till queued and in-progress async requests processed or context canceled, then stops workers. HTTP server which
+// serves Handler should be shut down before, so new requests are not accepted. Returns context error if queue has
+// not been drained.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.webhooks.MarkDraining()
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if !srv.started {
+		return nil
+	}
+	err := srv.webhooks.Drain(ctx)
+	srv.stopWorkers()
+	srv.waitWorkers()
+	return err
+}
+
+// Liveness returns handler of liveness probe, which always responds 200.
+func Liveness() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+}
+
+// Readiness returns handler of readiness probe, which responds 503 till webhooks are ready (see Webhooks.IsReady)
+// or while queue is not reachable (see Webhooks.PingQueue).
+func Readiness(webhooks *Webhooks) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !webhooks.IsReady() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err := webhooks.PingQueue(request.Context()); err != nil {
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	})
+}
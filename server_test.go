@@ -0,0 +1,105 @@
+package wd_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reddec/wd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+	srv, err := wd.NewServer(wd.ServerConfig{
+		Config:          wd.Config{Delay: time.Millisecond},
+		Runner:          wd.StaticScript("sh", "-c", "echo -n $REQUEST_PATH | tee "+output),
+		MetricsEndpoint: "/metrics",
+		HealthChecks:    true,
+	})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(data)
+	}
+
+	code, _ := get("/hook")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not started")
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, srv.Start(ctx))
+	assert.ErrorIs(t, srv.Start(ctx), wd.ErrServerStarted)
+
+	code, body := get("/hook")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "/hook", body)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get("/async?async=true")
+	assert.Equal(t, http.StatusAccepted, code)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer shutdownCancel()
+	require.NoError(t, srv.Shutdown(shutdownCtx))
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "/async", string(content), "async request processed before shutdown")
+
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, body = get("/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "webhooks_requests")
+}
+
+func TestServer_middleware(t *testing.T) {
+	srv, err := wd.NewServer(wd.ServerConfig{
+		Runner:       wd.StaticScript("echo", "-n", "ok"),
+		AsyncWorkers: -1,
+		HealthChecks: true,
+		Middleware: func(handler http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				if request.Header.Get("Authorization") == "" {
+					writer.WriteHeader(http.StatusForbidden)
+					return
+				}
+				handler.ServeHTTP(writer, request)
+			})
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, srv.Start(context.Background()))
+	defer srv.Shutdown(context.Background())
+
+	send := func(path string, authorized bool) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorized {
+			req.Header.Set("Authorization", "Bearer x")
+		}
+		res := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(res, req)
+		return res.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, send("/hook", false))
+	assert.Equal(t, http.StatusOK, send("/hook", true))
+	assert.Equal(t, http.StatusOK, send("/readyz", false), "health checks are not wrapped")
+}
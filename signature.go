@@ -0,0 +1,48 @@
+package wd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// VerifyHMAC checks HMAC-SHA256 signature (hex encoded) of request body in GitHub-style. Signature read from header,
+// optional prefix (ex: sha256=) is stripped. The 401 Unauthorized will be returned in case signature is not valid.
+//
+// Request body will be cached in memory, so it's recommended to limit request size by RequestSizeLimit.
+func VerifyHMAC(secret []byte, header string, prefix string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			signature, err := hex.DecodeString(strings.TrimPrefix(request.Header.Get(header), prefix))
+			if err != nil || len(signature) == 0 {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			data, err := ioutil.ReadAll(request.Body)
+			if errors.Is(err, ErrTooBigRequest) {
+				writer.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_ = request.Body.Close()
+
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(data)
+			if !hmac.Equal(mac.Sum(nil), signature) {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			request.Body = ioutil.NopCloser(bytes.NewReader(data))
+			handler.ServeHTTP(writer, request)
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package wd_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/reddec/wd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyHMAC(t *testing.T) {
+	secret := []byte("secret")
+	handler := wd.VerifyHMAC(secret, "X-Hub-Signature-256", "sha256=")(wd.New(wd.Config{}, wd.StaticScript("cat")))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("hello"))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	req.Header.Set("X-Hub-Signature-256", signature)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "hello", res.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("forged"))
+	req.Header.Set("X-Hub-Signature-256", signature)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
@@ -0,0 +1,178 @@
+package wd
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpillQueue creates in-memory queue with predefined size, which spills items to dir once memory is full instead
+// of blocking. Spilled items are loaded back to memory as space frees up. Push blocks only if total size of spilled
+// items exceeds maxDisk bytes. Zero or negative maxDisk means unlimited disk usage.
+//
+// Items are popped in FIFO order regardless of storage: once something is spilled, new items are spilled too till
+// disk is drained. Only item descriptors (see QueuedWebhook) are spilled, serialized requests are kept in
+// Config.QueueDir. Spilled items are not restored after restart.
+func SpillQueue(memSize int, dir string, maxDisk int64) Queue {
+	return &spillQueue{
+		memSize: memSize,
+		dir:     dir,
+		maxDisk: maxDisk,
+		memory:  list.New(),
+		disk:    list.New(),
+		changed: make(chan struct{}),
+	}
+}
+
+type spillQueue struct {
+	memSize  int
+	dir      string
+	maxDisk  int64
+	lock     sync.Mutex
+	memory   *list.List    // *QueuedWebhook, older than any spilled item
+	disk     *list.List    // spilledItem
+	diskSize int64         // total size of spilled items
+	changed  chan struct{} // closed and replaced on each push or pop
+}
+
+type spilledItem struct {
+	file     string
+	size     int64
+	enqueued time.Time
+}
+
+func (q *spillQueue) Push(ctx context.Context, value *QueuedWebhook) error {
+	for {
+		q.lock.Lock()
+		if q.disk.Len() == 0 && q.memory.Len() < q.memSize {
+			q.memory.PushBack(value)
+			q.notify()
+			q.lock.Unlock()
+			return nil
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			q.lock.Unlock()
+			return fmt.Errorf("serialize item: %w", err)
+		}
+		if q.maxDisk <= 0 || q.diskSize+int64(len(data)) <= q.maxDisk {
+			err := q.spill(data, value.Enqueued)
+			q.lock.Unlock()
+			return err
+		}
+		changed := q.changed
+		q.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (q *spillQueue) Pop(ctx context.Context) (*QueuedWebhook, error) {
+	for {
+		q.lock.Lock()
+		item := q.pop()
+		changed := q.changed
+		q.lock.Unlock()
+
+		if item != nil {
+			return item, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Oldest returns enqueue time of the first item or zero time if queue is empty.
+func (q *spillQueue) Oldest(context.Context) (time.Time, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if elem := q.memory.Front(); elem != nil {
+		return elem.Value.(*QueuedWebhook).Enqueued, nil
+	}
+	if elem := q.disk.Front(); elem != nil {
+		return elem.Value.(spilledItem).enqueued, nil
+	}
+	return time.Time{}, nil
+}
+
+// pop the oldest item and refill memory from disk. Must be called under lock.
+func (q *spillQueue) pop() *QueuedWebhook {
+	spilled := q.disk.Len()
+	var item *QueuedWebhook
+	if elem := q.memory.Front(); elem != nil {
+		item = q.memory.Remove(elem).(*QueuedWebhook)
+	}
+	for item == nil && q.disk.Len() > 0 {
+		item = q.unspill()
+	}
+	for q.memory.Len() < q.memSize && q.disk.Len() > 0 {
+		if restored := q.unspill(); restored != nil {
+			q.memory.PushBack(restored)
+		}
+	}
+	if item != nil || q.disk.Len() != spilled {
+		q.notify()
+	}
+	return item
+}
+
+// spill serialized item to disk. Must be called under lock.
+func (q *spillQueue) spill(data []byte, enqueued time.Time) error {
+	f, err := os.CreateTemp(q.dir, "spill-*.json")
+	if err != nil {
+		return fmt.Errorf("create spill file: %w", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("write spill file: %w", err)
+	}
+	q.disk.PushBack(spilledItem{file: f.Name(), size: int64(len(data)), enqueued: enqueued})
+	q.diskSize += int64(len(data))
+	q.notify()
+	return nil
+}
+
+// unspill removes the oldest item from disk. Returns nil if item can not be restored. Must be called under lock.
+func (q *spillQueue) unspill() *QueuedWebhook {
+	spilled := q.disk.Remove(q.disk.Front()).(spilledItem)
+	q.diskSize -= spilled.size
+	defer func() {
+		if err := os.Remove(spilled.file); err != nil {
+			slog.Warn("failed remove spill file", "file", spilled.file, "error", err)
+		}
+	}()
+	data, err := os.ReadFile(spilled.file)
+	if err != nil {
+		slog.Error("failed read spill file", "file", spilled.file, "error", err)
+		return nil
+	}
+	var item QueuedWebhook
+	if err := json.Unmarshal(data, &item); err != nil {
+		slog.Error("failed parse spill file", "file", spilled.file, "error", err)
+		return nil
+	}
+	return &item
+}
+
+// notify waiters about changes. Must be called under lock.
+func (q *spillQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
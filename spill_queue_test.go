@@ -0,0 +1,56 @@
+package wd_test
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reddec/wd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillQueue(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	t.Run("fifo across memory and disk", func(t *testing.T) {
+		queue := wd.SpillQueue(2, dir, 0)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, queue.Push(ctx, &wd.QueuedWebhook{Path: "/" + strconv.Itoa(i)}))
+		}
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, files, 3)
+
+		require.NoError(t, queue.Push(ctx, &wd.QueuedWebhook{Path: "/5"}))
+		for i := 0; i < 6; i++ {
+			item, err := queue.Pop(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "/"+strconv.Itoa(i), item.Path)
+		}
+		files, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("blocks once disk is full", func(t *testing.T) {
+		queue := wd.SpillQueue(1, dir, 1)
+		require.NoError(t, queue.Push(ctx, &wd.QueuedWebhook{Path: "/0"}))
+
+		pushCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, queue.Push(pushCtx, &wd.QueuedWebhook{Path: "/1"}), context.DeadlineExceeded)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = queue.Pop(ctx)
+		}()
+		require.NoError(t, queue.Push(ctx, &wd.QueuedWebhook{Path: "/1"}))
+		item, err := queue.Pop(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "/1", item.Path)
+	})
+}
@@ -0,0 +1,133 @@
+package wd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxTasks is maximum number of tracked tasks by in-memory store.
+const maxTasks = 8192
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// TaskState is state of async request.
+type TaskState string
+
+const (
+	TaskQueued    TaskState = "queued"    // waiting for worker
+	TaskRunning   TaskState = "running"   // attempt in progress
+	TaskRetrying  TaskState = "retrying"  // attempt failed, waiting for the next one
+	TaskSucceeded TaskState = "succeeded" // terminal: attempt succeeded
+	TaskFailed    TaskState = "failed"    // terminal: all attempts failed
+)
+
+// TaskStatus is current status of async request.
+type TaskStatus struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	State    TaskState `json:"state"`
+	Attempts uint      `json:"attempts"`        // number of started attempts
+	Error    string    `json:"error,omitempty"` // error of last failed attempt
+	Updated  time.Time `json:"updated"`
+}
+
+// TaskStore keeps statuses of async requests.
+type TaskStore interface {
+	// Set (create or replace) task status.
+	Set(ctx context.Context, status TaskStatus) error
+	// Get task status by ID. Returns ErrTaskNotFound if task is not known.
+	Get(ctx context.Context, id string) (*TaskStatus, error)
+}
+
+// NewMemoryTaskStore creates in-memory task store. Number of tasks is limited: the least recently updated task is
+// evicted once limit reached. Zero or negative limit means default (8192).
+func NewMemoryTaskStore(limit int) TaskStore {
+	if limit <= 0 {
+		limit = maxTasks
+	}
+	return &memoryTaskStore{limit: limit, tasks: make(map[string]TaskStatus)}
+}
+
+type memoryTaskStore struct {
+	lock  sync.Mutex
+	limit int
+	tasks map[string]TaskStatus
+}
+
+func (ms *memoryTaskStore) Set(_ context.Context, status TaskStatus) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exists := ms.tasks[status.ID]; !exists && len(ms.tasks) >= ms.limit {
+		ms.evictOldest()
+	}
+	ms.tasks[status.ID] = status
+	return nil
+}
+
+func (ms *memoryTaskStore) Get(_ context.Context, id string) (*TaskStatus, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	status, ok := ms.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	return &status, nil
+}
+
+func (ms *memoryTaskStore) evictOldest() {
+	var oldestID string
+	var oldest time.Time
+	for id, status := range ms.tasks {
+		if oldestID == "" || status.Updated.Before(oldest) {
+			oldestID = id
+			oldest = status.Updated
+		}
+	}
+	delete(ms.tasks, oldestID)
+}
+
+// Task returns status of async request by task ID. Returns ErrTaskNotFound if tasks are not tracked (see
+// Config.Tasks) or task is not known.
+func (wh *Webhooks) Task(ctx context.Context, id string) (*TaskStatus, error) {
+	if wh.config.Tasks == nil {
+		return nil, ErrTaskNotFound
+	}
+	return wh.config.Tasks.Get(ctx, id)
+}
+
+// setTaskState updates task status if tasks are tracked. Errors are only logged since task tracking is auxiliary.
+func (wh *Webhooks) setTaskState(ctx context.Context, item *QueuedWebhook, state TaskState, attempts uint, taskErr error) {
+	if wh.config.Tasks == nil || item.TaskID == "" {
+		return
+	}
+	status := TaskStatus{
+		ID:       item.TaskID,
+		Path:     item.Path,
+		State:    state,
+		Attempts: attempts,
+		Updated:  time.Now(),
+	}
+	if taskErr != nil {
+		status.Error = taskErr.Error()
+	}
+	if err := wh.config.Tasks.Set(ctx, status); err != nil {
+		wh.config.Logger.Warn("failed update task status", "task", item.TaskID, "state", state, "error", err)
+	}
+}
+
+// newTaskID generates random UUID (version 4).
+func newTaskID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("generate task id: %w", err)
+	}
+	id[6] = (id[6] & 0x0f) | 0x40 // version 4
+	id[8] = (id[8] & 0x3f) | 0x80 // variant RFC 4122
+	hexID := hex.EncodeToString(id[:])
+	return hexID[0:8] + "-" + hexID[8:12] + "-" + hexID[12:16] + "-" + hexID[16:20] + "-" + hexID[20:], nil
+}
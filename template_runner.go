@@ -0,0 +1,92 @@
+package wd
+
+import (
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// TemplateRunner wraps runner and expands Go templates (text/template) in arguments of command (not in command
+// itself) by request data (see TemplateContext). For example, argument {{.Query.branch}} is replaced by value of
+// query param branch, {{index .Header "X-Event"}} - by value of header X-Event.
+//
+// Each argument is expanded separately and always produces exactly one argument, so values can not inject additional
+// arguments. Values can not inject options either: if argument does not start with dash, expanded argument should not
+// start with dash. Requests with missed values (param or header is not defined), invalid templates or rejected
+// values are not matched (nil manifest).
+type TemplateRunner struct {
+	Runner Runner
+}
+
+// TemplateContext is request data available in argument templates of TemplateRunner.
+type TemplateContext struct {
+	Path   string            // request path (ex: /deploy)
+	Method string            // request method (ex: POST)
+	Query  map[string]string // the first value of each query param
+	Header map[string]string // the first value of each header by canonical name (ex: X-Event)
+}
+
+func (tr *TemplateRunner) Command(req *http.Request, defaultManifest Manifest) *Manifest {
+	manifest := tr.Runner.Command(req, defaultManifest)
+	if manifest == nil || len(manifest.Command) < 2 {
+		return manifest
+	}
+	var data *TemplateContext
+	args := make([]string, len(manifest.Command))
+	args[0] = manifest.Command[0]
+	for i, arg := range manifest.Command[1:] {
+		if !strings.Contains(arg, "{{") {
+			args[i+1] = arg
+			continue
+		}
+		if data == nil {
+			data = newTemplateContext(req)
+		}
+		value, ok := expandArg(arg, data)
+		if !ok {
+			return nil
+		}
+		args[i+1] = value
+	}
+	// manifest may be shared by runner
+	expanded := *manifest
+	expanded.Command = args
+	return &expanded
+}
+
+func newTemplateContext(req *http.Request) *TemplateContext {
+	data := &TemplateContext{
+		Path:   req.URL.Path,
+		Method: req.Method,
+		Query:  make(map[string]string),
+		Header: make(map[string]string, len(req.Header)),
+	}
+	for name, values := range req.URL.Query() {
+		if len(values) > 0 {
+			data.Query[name] = values[0]
+		}
+	}
+	for name, values := range req.Header {
+		if len(values) > 0 {
+			data.Header[name] = values[0]
+		}
+	}
+	return data
+}
+
+// expandArg expands template in argument. Returns false if template invalid, value missed or rejected.
+func expandArg(arg string, data *TemplateContext) (string, bool) {
+	tpl, err := template.New("").Option("missingkey=error").Parse(arg)
+	if err != nil {
+		return "", false
+	}
+	var out strings.Builder
+	if err := tpl.Execute(&out, data); err != nil {
+		return "", false
+	}
+	value := out.String()
+	if strings.ContainsRune(value, 0) || (strings.HasPrefix(value, "-") && !strings.HasPrefix(arg, "-")) {
+		return "", false
+	}
+	return value, true
+}
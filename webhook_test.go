@@ -1,14 +1,37 @@
 package wd_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pkg/xattr"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/reddec/wd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -52,6 +75,2262 @@ func Test_scriptRunner(t *testing.T) {
 	})
 }
 
+func Test_scriptHeaders(t *testing.T) {
+	wh := wd.New(wd.Config{ParseScriptHeaders: true}, wd.StaticScript("printf", `Status: 201\nX-Foo: bar\n\nhello`))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, "bar", res.Header().Get("X-Foo"))
+	assert.Equal(t, "hello", res.Body.String())
+
+	t.Run("no headers block", func(t *testing.T) {
+		wh := wd.New(wd.Config{ParseScriptHeaders: true}, wd.StaticScript("echo", "-n", "123"))
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "123", res.Body.String())
+	})
+}
+
+func Test_scriptRunnerDirectory(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	require.NoError(t, os.Mkdir(env.Path("subdir"), 0755))
+
+	wh := wd.New(wd.Config{}, &wd.DirectoryRunner{
+		ScriptsDir: env.dir,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/subdir", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func Test_mapRunner(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	routesFile := env.Path("routes.yaml")
+	err := ioutil.WriteFile(routesFile, []byte(`
+/hello:
+  command: ["echo", "-n", "hello"]
+  timeout: 5s
+/background:
+  command: ["true"]
+  async: forced
+`), 0600)
+	require.NoError(t, err)
+
+	runner, err := wd.LoadMapRunner(routesFile)
+	require.NoError(t, err)
+
+	wh := wd.New(wd.Config{}, runner)
+
+	req := httptest.NewRequest(http.MethodPost, "/hello", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "hello", res.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/background", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusAccepted, res.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/unknown", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func Test_maxResponse(t *testing.T) {
+	wh := wd.New(wd.Config{BufferSize: 1024}, wd.NewMapRunner(map[string]wd.Manifest{
+		"/small": {Command: []string{"echo", "-n", "123"}, MaxResponse: 4},
+		"/large": {Command: []string{"echo", "-n", "1234567890"}, MaxResponse: 4},
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/small", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "123", res.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/large", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
+
+func Test_maxResponseSize(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{MaxResponseSize: 4, Registerer: registry}, wd.NewMapRunner(map[string]wd.Manifest{
+		"/small":    {Command: []string{"echo", "-n", "123"}},
+		"/large":    {Command: []string{"echo", "-n", "1234567890"}},
+		"/override": {Command: []string{"echo", "-n", "1234567890"}, MaxResponse: 100},
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/small", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/large", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "1234", res.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/override", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "1234567890", res.Body.String())
+
+	assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_truncated"))
+}
+
+func Test_starting(t *testing.T) {
+	wh := wd.New(wd.Config{Starting: true}, wd.StaticScript("echo", "-n", "123"))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	wh.MarkReady()
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func Test_draining(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	started := env.Path("started")
+	wh := wd.New(wd.Config{}, wd.StaticScript(env.Path(env.Script("touch "+started+"\nsleep 1\necho -n 123"))))
+
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wh.ServeHTTP(inFlight, httptest.NewRequest(http.MethodPost, "/", nil))
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(started)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	wh.MarkDraining()
+	assert.False(t, wh.IsReady())
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+
+	<-done
+	assert.Equal(t, http.StatusOK, inFlight.Code, "in-flight request finished")
+	assert.Equal(t, "123", inFlight.Body.String())
+}
+
+func Test_notFoundHandler(t *testing.T) {
+	wh := wd.New(wd.Config{
+		NotFoundHandler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte(`{"error":"not found"}`))
+		}),
+	}, wd.NewMapRunner(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/unknown", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error":"not found"}`, res.Body.String())
+}
+
+func Test_skipBodylessPayload(t *testing.T) {
+	cases := []struct {
+		ArgType wd.ArgType
+		Script  string
+		Default string
+		Skipped string
+	}{
+		{ArgType: wd.ArgTypeStdin, Script: "cat", Default: "", Skipped: ""},
+		{ArgType: wd.ArgTypeParam, Script: `echo -n $#`, Default: "1", Skipped: "0"},
+		{ArgType: wd.ArgTypeEnv, Script: `echo -n ${REQUEST_BODY+set}`, Default: "set", Skipped: ""},
+	}
+	for _, c := range cases {
+		for _, skip := range []bool{false, true} {
+			wh := wd.New(wd.Config{ArgType: c.ArgType, SkipBodylessPayload: skip}, wd.StaticScript("sh", "-c", c.Script, "sh"))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			res := httptest.NewRecorder()
+			wh.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusOK, res.Code)
+			if skip {
+				assert.Equal(t, c.Skipped, res.Body.String(), c.ArgType)
+			} else {
+				assert.Equal(t, c.Default, res.Body.String(), c.ArgType)
+			}
+		}
+	}
+}
+
+func Test_binaryBody(t *testing.T) {
+	send := func(wh *wd.Webhooks, body string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return res
+	}
+
+	for _, argType := range []wd.ArgType{wd.ArgTypeEnv, wd.ArgTypeParam} {
+		script := wd.StaticScript("sh", "-c", `echo -n "$REQUEST_BODY_ENCODING:${REQUEST_BODY:-$1}"`, "sh")
+
+		wh := wd.New(wd.Config{ArgType: argType}, script)
+		res := send(wh, "a=b\nc")
+		assert.Equal(t, http.StatusOK, res.Code, argType)
+		assert.Equal(t, ":a=b\nc", res.Body.String(), argType)
+		assert.Equal(t, http.StatusBadRequest, send(wh, "a\x00b").Code, argType)
+
+		wh = wd.New(wd.Config{ArgType: argType, BinaryBody: wd.BinaryBodyBase64}, script)
+		res = send(wh, "a\x00b")
+		assert.Equal(t, http.StatusOK, res.Code, argType)
+		assert.Equal(t, "base64:YQBi", res.Body.String(), argType)
+	}
+}
+
+func Test_canceledWhileWaitingWorker(t *testing.T) {
+	wh := wd.New(wd.Config{Workers: 1}, wd.StaticScript("sleep", "1"))
+
+	go wh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, wd.StatusClientClosedRequest, res.Code)
+}
+
+func Test_pathWorkers(t *testing.T) {
+	wh := wd.New(wd.Config{PathWorkers: 1}, wd.StaticScript("sleep", "1"))
+
+	go wh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slow", nil))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/slow", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.NotEqual(t, http.StatusOK, res.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/fast", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func Test_execPath(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := env.Script(`echo -n "$PATH"`)
+
+	wh := wd.New(wd.Config{ExecPath: env.dir}, wd.StaticScript(script))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, env.dir, res.Body.String())
+
+	wh = wd.New(wd.Config{ExecPath: env.dir}, wd.StaticScript("echo"))
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadGateway, res.Code)
+}
+
+func Test_execPathRelative(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	// executable in current directory with name of system binary
+	require.NoError(t, ioutil.WriteFile(env.Path("true"), []byte("#!/bin/sh\n"), 0755))
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(env.dir))
+	defer os.Chdir(cwd)
+
+	sep := string(os.PathListSeparator)
+	for _, execPath := range []string{".", sep, sep + "."} {
+		wh := wd.New(wd.Config{ExecPath: execPath}, wd.StaticScript("true"))
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+		assert.Equal(t, http.StatusBadGateway, res.Code, "exec path %q", execPath)
+	}
+}
+
+func Test_configRunner(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	routesFile := env.Path("routes.json")
+	err := ioutil.WriteFile(routesFile, []byte(`{"/hello": {"command": ["echo", "-n", "hello"], "methods": ["POST"]}}`), 0600)
+	require.NoError(t, err)
+
+	runner, err := wd.NewConfigRunner(routesFile)
+	require.NoError(t, err)
+
+	wh := wd.New(wd.Config{}, runner)
+
+	req := httptest.NewRequest(http.MethodPost, "/hello", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "hello", res.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/hello", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+	assert.Equal(t, "POST", res.Header().Get("Allow"))
+
+	err = ioutil.WriteFile(routesFile, []byte(`{"/hello": {"command": ["echo", "-n", "world"]}}`), 0600)
+	require.NoError(t, err)
+	require.NoError(t, runner.Reload())
+
+	req = httptest.NewRequest(http.MethodGet, "/hello", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "world", res.Body.String())
+}
+
+func Test_timeoutPartialOutput(t *testing.T) {
+	t.Run("hung immediately", func(t *testing.T) {
+		wh := wd.New(wd.Config{Timeout: 100 * time.Millisecond, BufferSize: 1024}, wd.StaticScript("sh", "-c", "exec sleep 5"))
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+		assert.Empty(t, res.Body.String())
+	})
+
+	t.Run("printed then hung", func(t *testing.T) {
+		wh := wd.New(wd.Config{Timeout: 100 * time.Millisecond, BufferSize: 1024}, wd.StaticScript("sh", "-c", "printf partial; exec sleep 5"))
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+		assert.Equal(t, "partial", res.Body.String())
+	})
+
+	t.Run("printed then hung with discard", func(t *testing.T) {
+		wh := wd.New(wd.Config{Timeout: 100 * time.Millisecond, BufferSize: 1024, DiscardPartialOutput: true}, wd.StaticScript("sh", "-c", "printf partial; exec sleep 5"))
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+		assert.Empty(t, res.Body.String())
+	})
+}
+
+func Test_workDirAttr(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := env.Script("echo -n $(pwd)")
+	require.NoError(t, xattr.Set(env.Path(script), wd.AttrWorkDir, []byte(env.dir)))
+
+	wh := wd.New(wd.Config{TempDir: true}, &wd.DirectoryRunner{
+		ScriptsDir: env.dir,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/"+script, nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, env.dir, res.Body.String())
+
+	require.NoError(t, xattr.Set(env.Path(script), wd.AttrWorkDir, []byte(env.Path("missing"))))
+
+	req = httptest.NewRequest(http.MethodPost, "/"+script, nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Contains(t, res.Header().Get("X-Error"), "invalid work dir")
+}
+
+func Test_tempDirsGuard(t *testing.T) {
+	t.Run("max temp dirs", func(t *testing.T) {
+		wh := wd.New(wd.Config{TempDir: true, MaxTempDirs: 1}, wd.StaticScript("sleep", "1"))
+
+		go wh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+		time.Sleep(100 * time.Millisecond)
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	})
+
+	t.Run("min free space", func(t *testing.T) {
+		wh := wd.New(wd.Config{TempDir: true, MinFreeSpace: math.MaxUint64}, wd.StaticScript("true"))
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	})
+}
+
+func Test_bufferingHints(t *testing.T) {
+	wh := wd.New(wd.Config{BufferSize: 1024, MaxBufferSize: 4096}, wd.StaticScript("sh", "-c", "printf partial; exit 1"))
+
+	t.Run("buffered", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusBadGateway, res.Code)
+		assert.Equal(t, "7", res.Header().Get("Content-Length"))
+	})
+
+	t.Run("streamed by query", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/?stream=1", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "partial", res.Body.String())
+		assert.Empty(t, res.Header().Get("Content-Length"))
+	})
+
+	t.Run("streamed by accept", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+
+	t.Run("small buffer", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/?buffer=2", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+}
+
+func Test_timeoutHint(t *testing.T) {
+	wh := wd.New(wd.Config{Timeout: 5 * time.Second}, wd.StaticScript("sleep", "1"))
+
+	req := httptest.NewRequest(http.MethodPost, "/?timeout=100ms", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("X-Timeout", "100ms")
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+
+	wh = wd.New(wd.Config{Timeout: 100 * time.Millisecond}, wd.StaticScript("sleep", "1"))
+
+	req = httptest.NewRequest(http.MethodPost, "/?timeout=1h", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+}
+
+func Test_syncAttempt(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	wh := wd.New(wd.Config{}, wd.StaticScript(env.Path(env.Script(`echo -n "$HEADER_X_ATTEMPT"`))))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "1", res.Body.String())
+}
+
+func Test_logger(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	var logs bytes.Buffer
+	wh := wd.New(wd.Config{
+		Logger: slog.New(slog.NewJSONHandler(&logs, nil)),
+	}, wd.StaticScript(env.Path(env.Script("echo 123"))))
+
+	req := httptest.NewRequest(http.MethodGet, "/hook", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var record struct {
+		Msg    string `json:"msg"`
+		Path   string `json:"path"`
+		Status int    `json:"status"`
+	}
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &record))
+	assert.Equal(t, "request processed", record.Msg)
+	assert.Equal(t, "/hook", record.Path)
+	assert.Equal(t, http.StatusOK, record.Status)
+}
+
+func Test_failureLog(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	var logs bytes.Buffer
+	wh := wd.New(wd.Config{
+		Logger: slog.New(slog.NewJSONHandler(&logs, nil)),
+	}, wd.StaticScript(env.Path(env.Script("echo oops >&2\nexit 3"))))
+
+	req := httptest.NewRequest(http.MethodGet, "/hook", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadGateway, res.Code)
+
+	var found bool
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var record struct {
+			Msg      string `json:"msg"`
+			Path     string `json:"path"`
+			Attempt  string `json:"attempt"`
+			ExitCode int    `json:"exit_code"`
+			Stderr   string `json:"stderr"`
+		}
+		require.NoError(t, decoder.Decode(&record))
+		if record.Msg != "script failed" {
+			continue
+		}
+		found = true
+		assert.Equal(t, "/hook", record.Path)
+		assert.Equal(t, "1", record.Attempt)
+		assert.Equal(t, 3, record.ExitCode)
+		assert.Equal(t, "oops\n", record.Stderr)
+	}
+	assert.True(t, found)
+}
+
+func Test_asyncFailures(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Async:      wd.AsyncModeForced,
+		Retries:    2,
+		Delay:      time.Millisecond,
+		Registerer: registry,
+	}, wd.StaticScript(env.Path(env.Script("echo -n x >> "+attempts+"\nexit 1"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	req := httptest.NewRequest(http.MethodPost, "/fail", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := ioutil.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "xxx", string(content))
+	assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_async_failures"))
+	assert.Equal(t, 0.0, counterValue(t, registry, "webhooks_async_successes"))
+}
+
+func Test_noRetryExitCode(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Async:           wd.AsyncModeForced,
+		Retries:         2,
+		Delay:           time.Millisecond,
+		NoRetryExitCode: 3,
+		Registerer:      registry,
+	}, wd.StaticScript(env.Path(env.Script("echo -n x >> "+attempts+"\nexit 3"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	req := httptest.NewRequest(http.MethodPost, "/fail", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := ioutil.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(content))
+	assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_async_failures"))
+}
+
+func Test_autoStartWorkers(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	output := env.Path("output")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wh := wd.New(wd.Config{
+		Async:            wd.AsyncModeForced,
+		AutoStartWorkers: 2,
+		WorkersContext:   ctx,
+	}, wd.StaticScript(env.Path(env.Script("echo -n ok > "+output))))
+	defer wh.Close()
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(content))
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		_ = wh.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers not stopped")
+	}
+}
+
+func Test_idempotencyBuffered(t *testing.T) {
+	wh := wd.New(wd.Config{
+		Idempotency: wd.NewMemoryIdempotencyStore(0),
+		BufferSize:  8192,
+	}, wd.StaticScript("echo", "-n", "ok"))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set(wd.IdempotencyKeyHeader, "a")
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send()
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "ok", res.Body.String())
+
+	res = send()
+	assert.Equal(t, http.StatusOK, res.Code, "status of buffered response saved")
+	assert.Equal(t, "true", res.Header().Get(wd.IdempotentReplayedHeader))
+}
+
+func Test_idempotency(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	runs := env.Path("runs")
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Idempotency: wd.NewMemoryIdempotencyStore(0),
+		Tasks:       wd.NewMemoryTaskStore(0),
+		Delay:       time.Millisecond,
+		Registerer:  registry,
+	}, wd.StaticScript(env.Path(env.Script("echo -n x >> "+runs+"\n[ -z \"$QUERY_SLEEP\" ] || sleep 1\necho -n ok"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	send := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if key != "" {
+			req.Header.Set(wd.IdempotencyKeyHeader, key)
+		}
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		return res
+	}
+	countRuns := func() int {
+		drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer drainCancel()
+		require.NoError(t, wh.Drain(drainCtx))
+		content, err := os.ReadFile(runs)
+		require.NoError(t, err)
+		return len(content)
+	}
+
+	res := send("/sync", "a")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "ok", res.Body.String())
+	assert.Empty(t, res.Header().Get(wd.IdempotentReplayedHeader))
+
+	res = send("/sync", "a")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, res.Body.String())
+	assert.Equal(t, "true", res.Header().Get(wd.IdempotentReplayedHeader))
+	assert.Equal(t, 1, countRuns())
+
+	// keys are scoped by path, requests without keys are not deduplicated
+	send("/other", "a")
+	send("/sync", "")
+	send("/sync", "")
+	assert.Equal(t, 4, countRuns())
+
+	res = send("/async?async=true", "b")
+	require.Equal(t, http.StatusAccepted, res.Code)
+	taskID := res.Header().Get("X-Task-Id")
+	require.NotEmpty(t, taskID)
+	res = send("/async?async=true", "b")
+	assert.Equal(t, http.StatusAccepted, res.Code)
+	assert.Equal(t, taskID, res.Header().Get("X-Task-Id"))
+	assert.Equal(t, taskID, res.Body.String())
+	assert.Equal(t, 5, countRuns())
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		send("/slow?sleep=1", "c")
+	}()
+	<-started
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, http.StatusConflict, send("/slow?sleep=1", "c").Code)
+	<-done
+
+	assert.Equal(t, 3.0, counterValue(t, registry, "webhooks_replayed"))
+}
+
+func Test_retryBudget(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Async:       wd.AsyncModeForced,
+		Retries:     20,
+		Delay:       time.Millisecond,
+		RetryBudget: 0.5,
+		Registerer:  registry,
+	}, wd.StaticScript(env.Path(env.Script("echo -n x >> "+attempts+"\n[ -n \"$HEADER_X_OK\" ]"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	send := func(ok bool) int {
+		require.NoError(t, os.RemoveAll(attempts))
+		req := httptest.NewRequest(http.MethodPost, "/fail", nil)
+		if ok {
+			req.Header.Set("X-Ok", "1")
+		}
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		require.Equal(t, http.StatusAccepted, res.Code)
+
+		drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer drainCancel()
+		require.NoError(t, wh.Drain(drainCtx))
+
+		content, err := os.ReadFile(attempts)
+		require.NoError(t, err)
+		return len(content)
+	}
+
+	assert.Equal(t, 11, send(false), "first attempt and reserved retries")
+	assert.Equal(t, 1, send(false), "budget exhausted")
+	assert.Equal(t, 1, send(true))
+	assert.Equal(t, 1, send(true))
+	assert.Equal(t, 2, send(false), "budget replenished by successes")
+	assert.Equal(t, 3.0, counterValue(t, registry, "webhooks_async_retry_budget_exhausted"))
+}
+
+func Test_maxAsyncLifetime(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Async:            wd.AsyncModeForced,
+		Retries:          10,
+		Delay:            100 * time.Millisecond,
+		MaxAsyncLifetime: 150 * time.Millisecond,
+		Registerer:       registry,
+	}, wd.StaticScript(env.Path(env.Script("echo -n x >> "+attempts+"\nexit 1"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	req := httptest.NewRequest(http.MethodPost, "/fail", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := ioutil.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "xx", string(content))
+	assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_async_failures"))
+}
+
+// staleQueue pretends that items were enqueued long time ago.
+type staleQueue struct {
+	wd.Queue
+}
+
+func (q staleQueue) Pop(ctx context.Context) (*wd.QueuedWebhook, error) {
+	item, err := q.Queue.Pop(ctx)
+	if err == nil {
+		item.Enqueued = item.Enqueued.Add(-time.Hour)
+	}
+	return item, err
+}
+
+func Test_maxAsyncLifetimeSinceEnqueue(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	script := wd.StaticScript(env.Path(env.Script("echo -n x >> " + attempts + "\nexit 1")))
+	run := func(config wd.Config) *prometheus.Registry {
+		require.NoError(t, os.RemoveAll(attempts))
+		registry := prometheus.NewRegistry()
+		config.Async = wd.AsyncModeForced
+		config.Registerer = registry
+		wh := wd.New(config, script)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go wh.Run(ctx)
+
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/fail", nil))
+		require.Equal(t, http.StatusAccepted, res.Code)
+
+		drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer drainCancel()
+		require.NoError(t, wh.Drain(drainCtx))
+		return registry
+	}
+
+	t.Run("time in queue", func(t *testing.T) {
+		registry := run(wd.Config{MaxAsyncLifetime: time.Minute, Queue: staleQueue{Queue: wd.Unbound()}})
+		_, err := os.Stat(attempts)
+		assert.True(t, os.IsNotExist(err), "no attempts")
+		assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_async_failures"))
+	})
+
+	t.Run("delay capped", func(t *testing.T) {
+		registry := run(wd.Config{Retries: 2, Delay: time.Hour, MaxAsyncLifetime: 100 * time.Millisecond})
+		content, err := ioutil.ReadFile(attempts)
+		require.NoError(t, err)
+		assert.Equal(t, "x", string(content))
+		assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_async_failures"))
+	})
+}
+
+func Test_retryAfter(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	run := func(config wd.Config, script string) time.Duration {
+		require.NoError(t, os.RemoveAll(attempts))
+		config.Async = wd.AsyncModeForced
+		config.Retries = 1
+		config.Delay = 200 * time.Millisecond
+		wh := wd.New(config, wd.StaticScript(env.Path(env.Script("echo -n x >> "+attempts+"\n"+script))))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go wh.Run(ctx)
+
+		started := time.Now()
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+		require.Equal(t, http.StatusAccepted, res.Code)
+		drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer drainCancel()
+		require.NoError(t, wh.Drain(drainCtx))
+
+		content, err := ioutil.ReadFile(attempts)
+		require.NoError(t, err)
+		require.Equal(t, "xx", string(content))
+		return time.Since(started)
+	}
+
+	// capped by MaxRetryAfter
+	elapsed := run(wd.Config{ParseScriptHeaders: true, MaxRetryAfter: time.Second}, "echo 'Retry-After: 30'\necho\nexit 1")
+	assert.GreaterOrEqual(t, elapsed, time.Second)
+	assert.Less(t, elapsed, 2*time.Second)
+
+	// requested delay is less than default
+	elapsed = run(wd.Config{ParseScriptHeaders: true, MaxRetryAfter: time.Second}, "echo 'Retry-After: 0'\necho\nexit 1")
+	assert.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+
+	// backoff exit code
+	elapsed = run(wd.Config{MaxRetryAfter: 500 * time.Millisecond, BackoffExitCode: 75}, "exit 75")
+	assert.GreaterOrEqual(t, elapsed, 500*time.Millisecond)
+
+	// ignored without MaxRetryAfter
+	elapsed = run(wd.Config{ParseScriptHeaders: true}, "echo 'Retry-After: 30'\necho\nexit 1")
+	assert.Less(t, elapsed, time.Second)
+}
+
+func Test_requestDeadline(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := env.Path(env.Script("exec sleep 5"))
+	wh := wd.New(wd.Config{Timeout: 100 * time.Millisecond, RequestDeadline: time.Second}, wd.StaticScript(script))
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+	assert.NotContains(t, res.Header().Get("X-Error"), wd.ErrRequestDeadline.Error())
+
+	wh = wd.New(wd.Config{Timeout: time.Second, RequestDeadline: 100 * time.Millisecond}, wd.StaticScript(script))
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+	assert.Contains(t, res.Header().Get("X-Error"), wd.ErrRequestDeadline.Error())
+
+	// deadline exceeded while waiting for space in queue (no workers)
+	wh = wd.New(wd.Config{Async: wd.AsyncModeForced, Queue: wd.Limited(0), RequestDeadline: 100 * time.Millisecond}, wd.StaticScript(script))
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+	assert.Equal(t, wd.ErrRequestDeadline.Error(), res.Header().Get("X-Error"))
+}
+
+func Test_queueWait(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Async:      wd.AsyncModeForced,
+		Queue:      wd.Limited(10),
+		Registerer: registry,
+	}, wd.StaticScript("true"))
+	oldest := func() float64 {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "webhooks_queue_oldest_age_seconds" {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+		require.Equal(t, http.StatusAccepted, res.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.GreaterOrEqual(t, oldest(), 0.1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	assert.Equal(t, 0.0, oldest())
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "webhooks_queue_wait_seconds" {
+			wait := family.GetMetric()[0].GetHistogram()
+			assert.Equal(t, uint64(2), wait.GetSampleCount())
+			assert.GreaterOrEqual(t, wait.GetSampleSum(), 0.2)
+		}
+	}
+}
+
+func Test_maxConcurrent(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{MaxConcurrent: 1, Registerer: registry}, wd.StaticScript(env.Path(env.Script("exec sleep 0.5"))))
+	running := func() float64 {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "webhooks_running" {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- res.Code
+	}()
+	require.Eventually(t, func() bool { return running() == 1 }, time.Second, 10*time.Millisecond)
+
+	// second request waits for slot till canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	assert.Equal(t, wd.StatusClientClosedRequest, res.Code)
+
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, 0.0, running())
+}
+
+func Test_isSuccess(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	attempts := env.Path("attempts")
+	run := func(script string, isSuccess func(result wd.ExecutionInfo) bool) string {
+		require.NoError(t, os.RemoveAll(attempts))
+		wh := wd.New(wd.Config{
+			Async:     wd.AsyncModeForced,
+			Retries:   2,
+			Delay:     time.Millisecond,
+			IsSuccess: isSuccess,
+		}, wd.StaticScript(env.Path(env.Script("echo -n x >> "+attempts+"\n"+script))))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go wh.Run(ctx)
+
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+		require.Equal(t, http.StatusAccepted, res.Code)
+		drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer drainCancel()
+		require.NoError(t, wh.Drain(drainCtx))
+
+		content, err := ioutil.ReadFile(attempts)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// output rejected
+	var results []wd.ExecutionInfo
+	assert.Equal(t, "xxx", run("echo -n pending", func(result wd.ExecutionInfo) bool {
+		results = append(results, result)
+		return string(result.Output) != "pending"
+	}))
+	require.Len(t, results, 3)
+	assert.Equal(t, uint(3), results[2].Attempt)
+	assert.Equal(t, 0, results[2].ExitCode)
+
+	// non-zero exit code accepted
+	assert.Equal(t, "x", run("exit 2", func(result wd.ExecutionInfo) bool {
+		return result.ExitCode == 2
+	}))
+}
+
+func Test_pushCanceled(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	queueDir := env.Path("queue")
+	require.NoError(t, os.Mkdir(queueDir, 0755))
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Async:      wd.AsyncModeForced,
+		Queue:      wd.Limited(1),
+		QueueDir:   queueDir,
+		Registerer: registry,
+	}, wd.StaticScript("true"))
+
+	// no workers - the first request fills the queue
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx))
+	assert.Equal(t, wd.StatusClientClosedRequest, res.Code)
+	assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_queue_push_canceled"))
+
+	// spool file of canceled request removed
+	files, err := ioutil.ReadDir(queueDir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func Test_completionCallback(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	var calls int32
+	statuses := make(chan wd.TaskStatus, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// the first delivery fails
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var status wd.TaskStatus
+		assert.NoError(t, json.NewDecoder(request.Body).Decode(&status))
+		statuses <- status
+	}))
+	defer callback.Close()
+
+	wh := wd.New(wd.Config{
+		Async:              wd.AsyncModeForced,
+		Retries:            1,
+		Delay:              time.Millisecond,
+		CompletionCallback: callback.URL,
+	}, wd.StaticScript(env.Path(env.Script("exit 1"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/fail", nil))
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	require.Len(t, statuses, 1)
+	status := <-statuses
+	assert.Equal(t, "/fail", status.Path)
+	assert.Equal(t, wd.TaskFailed, status.State)
+	assert.Equal(t, uint(2), status.Attempts)
+	assert.Contains(t, status.Error, "exit status 1")
+}
+
+type blockingCodec struct {
+	wd.WireCodec
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bc *blockingCodec) Encode(w io.Writer, req *http.Request) error {
+	bc.started <- struct{}{}
+	<-bc.release
+	return bc.WireCodec.Encode(w, req)
+}
+
+func Test_maxSpooling(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	codec := &blockingCodec{started: make(chan struct{}, 2), release: make(chan struct{})}
+	wh := wd.New(wd.Config{Async: wd.AsyncModeForced, MaxSpooling: 1, Codec: codec, QueueDir: env.dir}, wd.StaticScript("true"))
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+		done <- res.Code
+	}()
+	<-codec.started
+
+	// second request waits for serialization slot till canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx))
+	assert.Equal(t, wd.StatusClientClosedRequest, res.Code)
+	assert.Len(t, codec.started, 0)
+
+	close(codec.release)
+	assert.Equal(t, http.StatusAccepted, <-done)
+}
+
+type countingCodec struct {
+	wd.WireCodec
+	encoded int32
+	decoded int32
+}
+
+func (cc *countingCodec) Encode(w io.Writer, req *http.Request) error {
+	atomic.AddInt32(&cc.encoded, 1)
+	return cc.WireCodec.Encode(w, req)
+}
+
+func (cc *countingCodec) Decode(r io.Reader) (*http.Request, error) {
+	atomic.AddInt32(&cc.decoded, 1)
+	return cc.WireCodec.Decode(r)
+}
+
+func Test_customCodec(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	output := env.Path("output")
+	codec := &countingCodec{}
+	wh := wd.New(wd.Config{
+		Async:   wd.AsyncModeForced,
+		Retries: 1,
+		Delay:   time.Millisecond,
+		Codec:   codec,
+	}, wd.StaticScript(env.Path(env.Script("cat >> "+output+"\nexit 1"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("hello"))
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "hellohello", string(content))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&codec.encoded))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&codec.decoded))
+}
+
+func Test_nice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("priority supported only on Linux")
+	}
+	env := New()
+	defer env.Clear()
+
+	output := env.Path("output")
+	// priority is set right after start
+	script := wd.StaticScript(env.Path(env.Script("sleep 0.2\nnice | tee -a " + output)))
+
+	wh := wd.New(wd.Config{Nice: 5, AsyncNice: 20}, script)
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "5\n", res.Body.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/?async=true", nil))
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "5\n19\n", string(content), "async niceness should be capped")
+}
+
+func Test_asyncClientAddr(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	output := env.Path("output")
+	wh := wd.New(wd.Config{Async: wd.AsyncModeForced},
+		wd.StaticScript(env.Path(env.Script(`echo -n "$CLIENT_ADDR|$CLIENT_IP|$CLIENT_CERT_CN" > `+output))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	cert := selfSignedCert(t, "alice")
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	content, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:1234|192.0.2.1|alice", string(content))
+}
+
+func selfSignedCert(t *testing.T, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func Test_tasks(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	wh := wd.New(wd.Config{
+		Async:        wd.AsyncModeForced,
+		Tasks:        wd.NewMemoryTaskStore(0),
+		TaskLocation: "/_tasks/",
+		Delay:        time.Millisecond,
+	}, wd.NewMapRunner(map[string]wd.Manifest{
+		"/ok":   {Command: []string{"true"}},
+		"/fail": {Command: []string{"false"}, Retries: 1},
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ids = make(map[string]string)
+	for _, path := range []string{"/ok", "/fail"} {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, path, nil))
+		require.Equal(t, http.StatusAccepted, res.Code)
+		id := res.Header().Get("X-Task-Id")
+		require.NotEmpty(t, id)
+		assert.Equal(t, id, res.Body.String())
+		assert.Equal(t, "/_tasks/"+id, res.Header().Get("Location"))
+		ids[path] = id
+
+		status, err := wh.Task(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, wd.TaskQueued, status.State)
+	}
+
+	go wh.Run(ctx)
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, wh.Drain(drainCtx))
+
+	status, err := wh.Task(ctx, ids["/ok"])
+	require.NoError(t, err)
+	assert.Equal(t, wd.TaskSucceeded, status.State)
+	assert.Equal(t, uint(1), status.Attempts)
+
+	status, err = wh.Task(ctx, ids["/fail"])
+	require.NoError(t, err)
+	assert.Equal(t, wd.TaskFailed, status.State)
+	assert.Equal(t, uint(2), status.Attempts)
+	assert.NotEmpty(t, status.Error)
+
+	_, err = wh.Task(ctx, "unknown")
+	assert.ErrorIs(t, err, wd.ErrTaskNotFound)
+}
+
+func Test_histogramBuckets(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Registerer:     registry,
+		PayloadBuckets: []float64{1024, 1024 * 1024},
+	}, wd.StaticScript("true"))
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("hello"))
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var bounds []float64
+	for _, family := range families {
+		if family.GetName() != "webhooks_payload" {
+			continue
+		}
+		for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			bounds = append(bounds, bucket.GetUpperBound())
+			assert.Equal(t, uint64(1), bucket.GetCumulativeCount())
+		}
+	}
+	assert.Equal(t, []float64{1024, 1024 * 1024}, bounds)
+}
+
+func counterValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var total float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	return total
+}
+
+func Test_exitCode(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	registry := prometheus.NewRegistry()
+	failing := wd.StaticScript(env.Path(env.Script(`exit 3`)))
+	wh := wd.New(wd.Config{Registerer: registry}, failing)
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, res.Code)
+	assert.Equal(t, "3", res.Header().Get(wd.ExitCodeHeader))
+	assert.Equal(t, float64(1), counterValue(t, registry, "webhooks_exit_codes_total"))
+
+	// killed by timeout
+	sleeping := wd.StaticScript(env.Path(env.Script(`exec sleep 5`)))
+	wh = wd.New(wd.Config{Timeout: 100 * time.Millisecond}, sleeping)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+	assert.Equal(t, wd.ExitCodeSignaled, res.Header().Get(wd.ExitCodeHeader))
+
+	// buffered success
+	wh = wd.New(wd.Config{}, wd.StaticScript("true"))
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/?buffer=1024", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "0", res.Header().Get(wd.ExitCodeHeader))
+}
+
+func TestStaticScriptEnv(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScriptEnv(map[string]string{
+		"ENVIRONMENT": "prod",
+		"QUERY_NAME":  "fixed",
+	}, env.Path(env.Script(`echo -n "$ENVIRONMENT $QUERY_NAME $QUERY_PAGE"`)))
+	wh := wd.New(wd.Config{}, script)
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/?name=client&page=2", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "prod fixed 2", res.Body.String())
+}
+
+func Test_exemplars(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{Registerer: registry, TraceID: wd.TraceParentID}, wd.StaticScript("true"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var traceIDs []string
+	for _, family := range families {
+		if family.GetName() != "webhooks_timing" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				for _, label := range bucket.GetExemplar().GetLabel() {
+					traceIDs = append(traceIDs, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.Equal(t, []string{"4bf92f3577b34da6a3ce929d0e0e4736"}, traceIDs)
+
+	for header, expected := range map[string]string{
+		"": "",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01":   "",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("traceparent", header)
+		assert.Equal(t, expected, wd.TraceParentID(req), header)
+	}
+}
+
+func TestCachedDirectoryRunner(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	runner, err := wd.NewCachedDirectoryRunner(&wd.DirectoryRunner{ScriptsDir: env.dir})
+	require.NoError(t, err)
+	defer runner.Close()
+
+	script := env.Script("echo 123")
+	req := httptest.NewRequest(http.MethodGet, "/"+script, nil)
+
+	manifest := runner.Command(req, wd.Manifest{})
+	require.NotNil(t, manifest)
+	assert.Equal(t, time.Duration(0), manifest.Timeout)
+
+	require.NoError(t, xattr.Set(env.Path(script), wd.AttrTimeout, []byte("5s")))
+	assert.Eventually(t, func() bool {
+		manifest := runner.Command(req, wd.Manifest{})
+		return manifest != nil && manifest.Timeout == 5*time.Second
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_flushInterval(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	wh := wd.New(wd.Config{
+		BufferSize:    8192,
+		FlushInterval: 50 * time.Millisecond,
+	}, wd.StaticScript(env.Path(env.Script("echo first\nsleep 1\necho second"))))
+
+	srv := httptest.NewServer(wh)
+	defer srv.Close()
+
+	started := time.Now()
+	res, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+}
+
+func Test_flushIntervalExitCode(t *testing.T) {
+	// exit code header must not race with periodic flush (run with -race)
+	wh := wd.New(wd.Config{
+		BufferSize:    8192,
+		FlushInterval: time.Millisecond,
+	}, wd.StaticScript("sh", "-c", "echo hi; sleep 0.001"))
+
+	srv := httptest.NewServer(wh)
+	defer srv.Close()
+
+	for i := 0; i < 20; i++ {
+		res, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		data, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hi\n", string(data))
+	}
+}
+
+func Test_bufferMemory(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScript(env.Path(env.Script("echo 123")))
+
+	t.Run("enough memory", func(t *testing.T) {
+		wh := wd.New(wd.Config{BufferSize: 8192, BufferMemory: 8192}, script)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "4", res.Header().Get("Content-Length"))
+	})
+
+	t.Run("memory exhausted", func(t *testing.T) {
+		wh := wd.New(wd.Config{BufferSize: 8192, BufferMemory: 1024}, script)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "", res.Header().Get("Content-Length"))
+		assert.Equal(t, "123\n", res.Body.String())
+	})
+}
+
+func Test_payloadFile(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := env.Script(`test "$1" = "$REQUEST_BODY_FILE"
+stat -c %a "$1"
+echo "$1"
+cat "$1"`)
+
+	wh := wd.New(wd.Config{ArgType: wd.ArgTypeFile, WorkDir: env.dir}, wd.StaticScript(env.Path(script)))
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("hello world"))
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+
+	lines := strings.SplitN(res.Body.String(), "\n", 3)
+	require.Len(t, lines, 3)
+	assert.Equal(t, "600", lines[0])
+	assert.Equal(t, env.dir, filepath.Dir(lines[1]))
+	assert.NoFileExists(t, lines[1])
+	assert.Equal(t, "hello world", lines[2])
+}
+
+func Test_multiValueEncoding(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScript(env.Path(env.Script(`echo -n "$QUERY_TAG|$QUERY_TAG_0|$QUERY_TAG_1"`)))
+
+	wh := wd.New(wd.Config{}, script)
+	req := httptest.NewRequest(http.MethodGet, "/?tag=a,b&tag=c", nil)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "a,b,c||", res.Body.String())
+
+	wh = wd.New(wd.Config{MultiValueEncoding: wd.MultiValueIndexed}, script)
+	req = httptest.NewRequest(http.MethodGet, "/?tag=a,b&tag=c", nil)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "a,b,c|a,b|c", res.Body.String())
+}
+
+func Test_lastErrors(t *testing.T) {
+	wh := wd.New(wd.Config{}, wd.NewMapRunner(map[string]wd.Manifest{
+		"/ok":   {Command: []string{"true"}},
+		"/fail": {Command: []string{"false"}},
+	}))
+
+	for _, path := range []string{"/ok", "/fail"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+	}
+
+	errs := wh.LastErrors()
+	require.Len(t, errs, 1)
+	assert.Equal(t, "exit status 1", errs["/fail"].Error)
+	assert.False(t, errs["/fail"].Time.IsZero())
+}
+
+func Test_lastErrorsRedacted(t *testing.T) {
+	wh := wd.New(wd.Config{RedactErrors: true}, wd.NewMapRunner(map[string]wd.Manifest{
+		"/fail":    {Command: []string{"false"}},
+		"/missing": {Command: []string{"/no/such/binary"}},
+	}))
+
+	for _, path := range []string{"/fail", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+	}
+
+	errs := wh.LastErrors()
+	require.Len(t, errs, 2)
+	assert.Equal(t, "exit status 1", errs["/fail"].Error)
+	assert.Equal(t, "internal error", errs["/missing"].Error, "path of binary not exposed")
+}
+
+func Test_envPrefixes(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScript(env.Path(env.Script(`echo -n "$H_X_NAME|$Q_PAGE|$HEADER_X_NAME|$QUERY_PAGE|$REQUEST_PATH"`)))
+
+	wh := wd.New(wd.Config{HeaderPrefix: "H_", QueryPrefix: "Q_"}, script)
+	req := httptest.NewRequest(http.MethodGet, "/hook?page=1", nil)
+	req.Header.Set("X-Name", "demo")
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "demo|1|||/hook", res.Body.String())
+
+	wh = wd.New(wd.Config{DisableHeadersEnv: true, DisableQueryEnv: true}, script)
+	req = httptest.NewRequest(http.MethodGet, "/hook?page=1", nil)
+	req.Header.Set("X-Name", "demo")
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "||||/hook", res.Body.String())
+}
+
+func Test_headerEnvPattern(t *testing.T) {
+	script := wd.StaticScript("sh", "-c", `echo -n "$HEADER_X_GITHUB_EVENT|$HEADER_X_GITHUB_DELIVERY|$HEADER_X_HUB_SIGNATURE_256|$HEADER_USER_AGENT|$HEADER_X_ATTEMPT"`)
+	send := func(wh *wd.Webhooks) string {
+		req := httptest.NewRequest(http.MethodPost, "/hook", nil)
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", "72d3162e")
+		req.Header.Set("X-Hub-Signature-256", "sha256=abc")
+		req.Header.Set("User-Agent", "GitHub-Hookshot/044aadd")
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		return res.Body.String()
+	}
+
+	wh := wd.New(wd.Config{HeaderEnvPattern: regexp.MustCompile(`(?i)^X-GitHub-`)}, script)
+	assert.Equal(t, "push|72d3162e|||1", send(wh))
+
+	wh = wd.New(wd.Config{HeaderEnvPattern: regexp.MustCompile(`^X-(Github|Hub)-`)}, script)
+	assert.Equal(t, "push|72d3162e|sha256=abc||1", send(wh))
+
+	wh = wd.New(wd.Config{}, script)
+	assert.Equal(t, "push|72d3162e|sha256=abc|GitHub-Hookshot/044aadd|1", send(wh))
+
+	wh = wd.New(wd.Config{HeaderEnvPattern: regexp.MustCompile(`.`), DisableHeadersEnv: true}, script)
+	assert.Equal(t, "||||", send(wh))
+}
+
+func Test_strictQuery(t *testing.T) {
+	wh := wd.New(wd.Config{StrictQuery: true, AllowedQuery: []string{"token"}}, wd.NewMapRunner(map[string]wd.Manifest{
+		"/hook": {Command: []string{"true"}, Query: []string{"page"}},
+	}))
+
+	for query, status := range map[string]int{
+		"":                      http.StatusOK,
+		"page=1&token=x":        http.StatusOK,
+		"page=1&async=0":        http.StatusOK,
+		"page=1&pgae=2":         http.StatusBadRequest,
+		"page=1&token=x&user=y": http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/hook?"+query, nil)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, status, res.Code, query)
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScript(env.Path(env.Script(`echo -n "$CLIENT_IP"`)))
+	wh := wd.New(wd.Config{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, script)
+
+	for _, tc := range []struct {
+		peer      string
+		forwarded string
+		expected  string
+	}{
+		{peer: "192.0.2.1:1234", expected: "192.0.2.1"},
+		{peer: "192.0.2.1:1234", forwarded: "203.0.113.1", expected: "192.0.2.1"},
+		{peer: "10.0.0.1:1234", expected: "10.0.0.1"},
+		{peer: "10.0.0.1:1234", forwarded: "203.0.113.1", expected: "203.0.113.1"},
+		{peer: "10.0.0.1:1234", forwarded: "198.51.100.1, 203.0.113.1, 10.0.0.2", expected: "203.0.113.1"},
+		{peer: "10.0.0.1:1234", forwarded: "10.0.0.3, 10.0.0.2", expected: "10.0.0.3"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.peer
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, tc.expected, res.Body.String(), tc.forwarded)
+	}
+}
+
+func Test_forwardedHeaders(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScript(env.Path(env.Script(`echo -n "$REQUEST_SCHEME $REQUEST_HOST $CLIENT_IP"`)))
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	call := func(config wd.Config, peer string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://internal:8080/", nil)
+		req.RemoteAddr = peer
+		req.Header.Set("X-Forwarded-Proto", "HTTPS")
+		req.Header.Set("X-Forwarded-Host", "example.com")
+		req.Header.Set("X-Real-IP", "203.0.113.1")
+		res := httptest.NewRecorder()
+		wd.New(config, script).ServeHTTP(res, req)
+		return res.Body.String()
+	}
+
+	assert.Equal(t, "https example.com 203.0.113.1", call(wd.Config{TrustedProxies: proxies, TrustForwarded: true}, "10.0.0.1:1234"))
+	// untrusted peer
+	assert.Equal(t, "http internal:8080 192.0.2.1", call(wd.Config{TrustedProxies: proxies, TrustForwarded: true}, "192.0.2.1:1234"))
+	// disabled by default
+	assert.Equal(t, "http internal:8080 10.0.0.1", call(wd.Config{TrustedProxies: proxies}, "10.0.0.1:1234"))
+
+	// values sent by client are prepended, proxies append values in step with X-Forwarded-For
+	chain := func(forwardedFor, proto, host string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://internal:8080/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", host)
+		res := httptest.NewRecorder()
+		wd.New(wd.Config{TrustedProxies: proxies, TrustForwarded: true}, script).ServeHTTP(res, req)
+		return res.Body.String()
+	}
+	assert.Equal(t, "http example.com 203.0.113.7", chain("203.0.113.7", "https, http", "evil.com, example.com"))
+	assert.Equal(t, "https example.com 203.0.113.7", chain("203.0.113.7, 10.0.0.2", "http, https, http", "evil.com, example.com, internal"))
+	assert.Equal(t, "https example.com 203.0.113.7", chain("198.51.100.1, 203.0.113.7, 10.0.0.2", "https, http", "example.com, internal"))
+}
+
+func Test_debugRequest(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := wd.StaticScript(env.Path(env.Script(`echo -n executed`)), "--flag")
+
+	wh := wd.New(wd.Config{AllowDebug: true, Async: wd.AsyncModeForced}, script)
+	req := httptest.NewRequest(http.MethodGet, "/hook?page=1", nil)
+	req.Header.Set(wd.DebugHeader, "1")
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+	var info wd.DebugInfo
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &info))
+	assert.Equal(t, []string{"--flag"}, info.Command[1:])
+	assert.Contains(t, info.Env, "QUERY_PAGE=1")
+	assert.Contains(t, info.Env, "REQUEST_PATH=/hook")
+	assert.NotContains(t, info.Env, "PATH="+os.Getenv("PATH"))
+	assert.Equal(t, wd.AsyncModeForced, info.Manifest.Async)
+
+	// header ignored if debug not allowed
+	wh = wd.New(wd.Config{}, script)
+	req = httptest.NewRequest(http.MethodGet, "/hook", nil)
+	req.Header.Set(wd.DebugHeader, "1")
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "executed", res.Body.String())
+}
+
+func Test_manifestOverride(t *testing.T) {
+	secret := []byte("orchestrator")
+	wh := wd.New(wd.Config{AllowDebug: true, Timeout: time.Minute, ManifestSecrets: [][]byte{[]byte("old"), secret}}, wd.StaticScript("true"))
+
+	const override = `{"timeout": "5s", "retries": 2, "delay": "1s", "async": "disabled"}`
+	manifestFor := func(signature string) wd.Manifest {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(wd.DebugHeader, "1")
+		req.Header.Set(wd.ManifestHeader, override)
+		req.Header.Set(wd.ManifestSignatureHeader, signature)
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		require.Equal(t, http.StatusOK, res.Code)
+		var info wd.DebugInfo
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &info))
+		return info.Manifest
+	}
+
+	manifest := manifestFor(wd.SignManifest(secret, override))
+	assert.Equal(t, 5*time.Second, manifest.Timeout)
+	assert.Equal(t, uint(2), manifest.Retries)
+	assert.Equal(t, time.Second, manifest.Delay)
+	assert.Equal(t, wd.AsyncModeDisabled, manifest.Async)
+
+	// invalid or missing signature - override ignored
+	for _, signature := range []string{"", "deadbeef", wd.SignManifest([]byte("other"), override)} {
+		manifest = manifestFor(signature)
+		assert.Equal(t, time.Minute, manifest.Timeout)
+		assert.Zero(t, manifest.Retries)
+	}
+}
+
+func Test_metricsPath(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		Registerer:  registry,
+		MetricsPath: wd.PathPatterns("/user/:id", "/user/:id/posts/:post"),
+	}, wd.StaticScript("true"))
+
+	for _, path := range []string{"/user/1", "/user/2", "/user/3/posts/4", "/other"} {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, res.Code)
+	}
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var requests = make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "webhooks_requests" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "path" {
+					requests[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"/user/:id": 2, "/user/:id/posts/:post": 1, "/other": 1}, requests)
+}
+
+func Test_clientCert(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	wh := wd.New(wd.Config{ClientCertPEM: true}, wd.StaticScript(env.Path(env.Script(`echo -n "$CLIENT_CERT_CN|$CLIENT_CERT_SAN|$CLIENT_CERT_SERIAL|$CLIENT_CERT_PEM"`))))
+
+	cert := &x509.Certificate{
+		Raw:            []byte("cert"),
+		SerialNumber:   big.NewInt(0xABC1),
+		Subject:        pkix.Name{CommonName: "alice"},
+		DNSNames:       []string{"alice.local"},
+		EmailAddresses: []string{"alice@example.com"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "|||", res.Body.String(), "not verified certificate should be ignored")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, "alice|alice.local,alice@example.com|ABC1|-----BEGIN CERTIFICATE-----\nY2VydA==\n-----END CERTIFICATE-----\n", res.Body.String())
+}
+
+func TestHostRouter(t *testing.T) {
+	wh := wd.New(wd.Config{}, &wd.HostRouter{
+		Hosts: map[string]wd.Runner{
+			"a.example.com": wd.StaticScript("echo", "-n", "a"),
+		},
+		Default: wd.NewMapRunner(map[string]wd.Manifest{
+			"/hook": {Command: []string{"echo", "-n", "default"}},
+		}),
+	})
+
+	for host, expected := range map[string]string{
+		"a.example.com":      "a",
+		"A.Example.com:8080": "a",
+		"b.example.com":      "default",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/hook", nil)
+		req.Host = host
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, expected, res.Body.String(), host)
+	}
+
+	wh = wd.New(wd.Config{}, &wd.HostRouter{})
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/hook", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestHeaderRouter(t *testing.T) {
+	wh := wd.New(wd.Config{}, &wd.HeaderRouter{
+		Header: "X-Event-Type",
+		Runner: wd.NewMapRunner(map[string]wd.Manifest{
+			"/hook":      {Command: []string{"echo", "-n", "hook"}},
+			"/hook/push": {Command: []string{"sh", "-c", "echo -n push $REQUEST_PATH"}},
+		}),
+	})
+
+	for event, expected := range map[string]int{
+		"":        http.StatusOK,
+		"push":    http.StatusOK,
+		"unknown": http.StatusNotFound,
+		"..":      http.StatusNotFound,
+		"push/..": http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/hook", nil)
+		if event != "" {
+			req.Header.Set("X-Event-Type", event)
+		}
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, expected, res.Code, event)
+		switch event {
+		case "":
+			assert.Equal(t, "hook", res.Body.String())
+		case "push":
+			assert.Equal(t, "push /hook", res.Body.String())
+		}
+	}
+}
+
+func TestTemplateRunner(t *testing.T) {
+	wh := wd.New(wd.Config{}, &wd.TemplateRunner{
+		Runner: wd.StaticScript("echo", "-n", "{{.Path}}", "--branch={{.Query.branch}}", `{{index .Header "X-Event"}}`),
+	})
+
+	for query, expected := range map[string]struct {
+		code int
+		body string
+	}{
+		"branch=main":              {http.StatusOK, "/hook --branch=main push"},
+		"branch=a+b":               {http.StatusOK, "/hook --branch=a b push"},
+		"branch=-n&branch=x":       {http.StatusOK, "/hook --branch=-n push"},
+		"":                         {http.StatusNotFound, ""},
+		"branch=%7B%7B.Path%7D%7D": {http.StatusOK, "/hook --branch={{.Path}} push"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/hook?"+query, nil)
+		req.Header.Set("X-Event", "push")
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, expected.code, res.Code, query)
+		if expected.code == http.StatusOK {
+			assert.Equal(t, expected.body, res.Body.String(), query)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/hook?branch=main", nil)
+	req.Header.Set("X-Event", "-n")
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code, "option injection")
+}
+
+func TestContentTypeRunner(t *testing.T) {
+	wh := wd.New(wd.Config{}, &wd.ContentTypeRunner{
+		Types: map[string]wd.Runner{
+			"application/json": wd.StaticScript("echo", "-n", "json"),
+			"text/*":           wd.StaticScript("echo", "-n", "text"),
+			"*/*":              wd.StaticScript("echo", "-n", "any"),
+		},
+		Default: wd.StaticScript("echo", "-n", "default"),
+	})
+
+	for contentType, expected := range map[string]string{
+		"application/json":                  "json",
+		"Application/JSON; charset=utf-8":   "json",
+		"text/plain":                        "text",
+		"application/x-www-form-urlencoded": "any",
+		"":                                  "default",
+		"invalid":                           "default",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/hook", nil)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		assert.Equal(t, expected, res.Body.String(), contentType)
+	}
+
+	wh = wd.New(wd.Config{}, &wd.ContentTypeRunner{})
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/hook", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestRewriteRunner(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	// scripts dir: scripts/v2/deploy.sh, outside of scripts dir: outside.sh
+	script := env.Script(`echo -n "$REQUEST_PATH"`)
+	require.NoError(t, os.MkdirAll(env.Path("scripts/v2"), 0755))
+	require.NoError(t, os.Link(env.Path(script), env.Path("scripts/v2/deploy.sh")))
+	require.NoError(t, os.Rename(env.Path(script), env.Path("outside.sh")))
+
+	var rules []wd.RewriteRule
+	for _, rule := range []string{`^/deploy$=/v2/deploy.sh`, `^/escape$=/../outside.sh`, `^/(\w+)/latest$=/v2/$1.sh`} {
+		parsed, err := wd.ParseRewriteRule(rule)
+		require.NoError(t, err)
+		rules = append(rules, parsed)
+	}
+	_, err := wd.ParseRewriteRule("no-replacement")
+	require.Error(t, err)
+
+	wh := wd.New(wd.Config{}, &wd.RewriteRunner{
+		Rules:  rules,
+		Runner: &wd.DirectoryRunner{ScriptsDir: env.Path("scripts")},
+	})
+
+	for path, status := range map[string]int{
+		"/deploy":        http.StatusOK,
+		"/deploy/latest": http.StatusOK,
+		"/v2/deploy.sh":  http.StatusOK,
+		"/escape":        http.StatusNotFound,
+		"/other":         http.StatusNotFound,
+	} {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, status, res.Code, path)
+		if status == http.StatusOK {
+			assert.Equal(t, path, res.Body.String(), "original path should be passed to script")
+		}
+	}
+}
+
+func Test_methods(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	script := env.Script(`echo -n ok`)
+	wh := wd.New(wd.Config{}, &wd.DirectoryRunner{ScriptsDir: env.dir})
+
+	// all methods allowed by default
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(method, "/"+script, nil))
+		assert.Equal(t, http.StatusOK, res.Code, method)
+	}
+
+	require.NoError(t, xattr.Set(env.Path(script), wd.AttrMethods, []byte("POST, put")))
+
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(method, "/"+script, nil))
+		assert.Equal(t, http.StatusOK, res.Code, method)
+		assert.Equal(t, "ok", res.Body.String())
+	}
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/"+script, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+	assert.Equal(t, "POST, PUT", res.Header().Get("Allow"))
+	assert.NotContains(t, res.Body.String(), "ok")
+}
+
+func TestDirectoryRunner_IndexFile(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	writeScript := func(name, content string) {
+		require.NoError(t, ioutil.WriteFile(env.Path(name), []byte("#!/bin/sh\n"+content), 0755))
+	}
+	require.NoError(t, os.Mkdir(env.Path("api"), 0755))
+	require.NoError(t, os.Mkdir(env.Path("empty"), 0755))
+	writeScript("index.sh", "echo -n root")
+	writeScript("api/index.sh", "echo -n api")
+
+	wh := wd.New(wd.Config{}, &wd.DirectoryRunner{ScriptsDir: env.dir, IndexFile: "index.sh"})
+	for path, expected := range map[string]string{"/": "root", "/api/": "api", "/api": "api", "/api/index.sh": "api"} {
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, res.Code, path)
+		assert.Equal(t, expected, res.Body.String(), path)
+	}
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/empty/", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	// directories are not served without index file
+	wh = wd.New(wd.Config{}, &wd.DirectoryRunner{ScriptsDir: env.dir})
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestDirectoryRunner_Describe(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	writeScript := func(name string, mode os.FileMode) {
+		require.NoError(t, ioutil.WriteFile(env.Path(name), []byte("#!/bin/sh\necho 123"), mode))
+	}
+	require.NoError(t, os.Mkdir(env.Path("api"), 0755))
+	writeScript("deploy", 0755)
+	writeScript("api/index.sh", 0755)
+	writeScript(".hidden", 0755)
+	writeScript("readme", 0644)
+	require.NoError(t, xattr.Set(env.Path("deploy"), wd.AttrMethods, []byte("POST,PUT")))
+	require.NoError(t, xattr.Set(env.Path("deploy"), wd.AttrAsync, []byte("forced")))
+	require.NoError(t, xattr.Set(env.Path("deploy"), wd.AttrQuery, []byte("env")))
+
+	runner := &wd.DirectoryRunner{ScriptsDir: env.dir, IndexFile: "index.sh"}
+	endpoints, err := runner.Describe(wd.Manifest{Async: wd.AsyncModeDisabled})
+	require.NoError(t, err)
+	assert.Equal(t, []wd.Endpoint{
+		{Path: "/api/", Async: wd.AsyncModeDisabled},
+		{Path: "/deploy", Methods: []string{"POST", "PUT"}, Async: wd.AsyncModeForced, Query: []string{"env"}},
+	}, endpoints)
+
+	res := httptest.NewRecorder()
+	wd.DescribeHandler("test", func() ([]wd.Endpoint, error) {
+		return endpoints, nil
+	}).ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/_openapi.json", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Responses   map[string]any `json:"responses"`
+			RequestBody any            `json:"requestBody"`
+		} `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &doc))
+	assert.Len(t, doc.Paths, 2)
+	assert.Contains(t, doc.Paths["/api/"], "get")
+	assert.Contains(t, doc.Paths["/api/"]["get"].Responses, "200")
+	assert.NotContains(t, doc.Paths["/api/"]["get"].Responses, "202")
+	assert.Nil(t, doc.Paths["/api/"]["get"].RequestBody)
+	assert.Contains(t, doc.Paths["/deploy"], "put")
+	assert.NotContains(t, doc.Paths["/deploy"], "get")
+	assert.Contains(t, doc.Paths["/deploy"]["post"].Responses, "202")
+	assert.NotContains(t, doc.Paths["/deploy"]["post"].Responses, "200")
+	assert.NotNil(t, doc.Paths["/deploy"]["post"].RequestBody)
+}
+
+func TestDirectoryRunner_Validate(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	runner := &wd.DirectoryRunner{ScriptsDir: env.dir}
+
+	script := env.Script("echo 123")
+	assert.Empty(t, runner.Validate())
+
+	require.NoError(t, xattr.Set(env.Path(script), wd.AttrTimeout, []byte("not a duration")))
+	require.NoError(t, ioutil.WriteFile(env.Path("plain"), []byte("data"), 0644))
+	require.NoError(t, os.Mkdir(env.Path(".hidden"), 0755))
+	require.NoError(t, ioutil.WriteFile(env.Path(".hidden/plain"), []byte("data"), 0644))
+
+	assert.Len(t, runner.Validate(), 2)
+
+	require.NoError(t, ioutil.WriteFile(env.Path("missing"), []byte("#!/no/such/interpreter\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(env.Path("env-missing"), []byte("#!/usr/bin/env no-such-interpreter\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(env.Path("env-ok"), []byte("#!/usr/bin/env sh\n"), 0755))
+	problems := runner.Validate()
+	assert.Len(t, problems, 4)
+	assert.Contains(t, fmt.Sprint(problems), "/no/such/interpreter")
+	assert.Contains(t, fmt.Sprint(problems), "no-such-interpreter not found in PATH")
+}
+
 type testEnv struct {
 	dir string
 }
@@ -93,3 +2372,158 @@ func (te *testEnv) Script(content string) string {
 func (te *testEnv) Path(name string) string {
 	return filepath.Join(te.dir, name)
 }
+
+func Test_rateLimit(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	wh := wd.New(wd.Config{
+		RateLimit:          wd.RateLimit{Requests: 2, Period: time.Minute},
+		RateLimitPerClient: true,
+		Registerer:         registry,
+	}, wd.StaticScript("echo", "-n", "ok"))
+
+	send := func(path, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = client + ":1234"
+		res := httptest.NewRecorder()
+		wh.ServeHTTP(res, req)
+		return res
+	}
+
+	assert.Equal(t, http.StatusOK, send("/a", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, send("/a", "10.0.0.1").Code)
+	res := send("/a", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "30", res.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, send("/a", "10.0.0.2").Code, "separate limit per client")
+	assert.Equal(t, http.StatusOK, send("/b", "10.0.0.1").Code, "separate limit per path")
+	assert.Equal(t, 1.0, counterValue(t, registry, "webhooks_rate_limited"))
+
+	var limit wd.RateLimit
+	require.NoError(t, limit.UnmarshalText([]byte("5/s")))
+	assert.Equal(t, wd.RateLimit{Requests: 5, Period: time.Second}, limit)
+	assert.ErrorIs(t, limit.UnmarshalText([]byte("5")), wd.ErrInvalidRateLimit)
+	assert.ErrorIs(t, limit.UnmarshalText([]byte("0/1m")), wd.ErrInvalidRateLimit)
+}
+
+func Test_runAs(t *testing.T) {
+	wh := wd.New(wd.Config{RunAsUser: "0", RunAsFileOwner: true}, wd.StaticScript("id", "-u"))
+	assert.ErrorIs(t, wh.CheckRunAs(), wd.ErrRunAsConflict)
+
+	wh = wd.New(wd.Config{RunAsUser: "no-such-user-wd"}, wd.StaticScript("id", "-u"))
+	assert.Error(t, wh.CheckRunAs())
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	wh = wd.New(wd.Config{RunAsUser: "65534", RunAsGroup: "65534"}, wd.StaticScript("sh", "-c", "echo -n $(id -u):$(id -g)"))
+	require.NoError(t, wh.CheckRunAs())
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "65534:65534", res.Body.String())
+}
+
+func Test_supplementaryGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	root, err := user.LookupId("0")
+	require.NoError(t, err)
+	groups, err := root.GroupIds()
+	require.NoError(t, err)
+
+	script := wd.StaticScript("sh", "-c", "id -G | tr ' ' '\\n'")
+	wh := wd.New(wd.Config{RunAsUser: "0", RunAsGroup: "65534"}, script)
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.ElementsMatch(t, append([]string{"65534"}, groups...), strings.Fields(res.Body.String()))
+
+	wh = wd.New(wd.Config{RunAsUser: "0", RunAsGroup: "65534", NoSupplementaryGroups: true}, script)
+	res = httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "65534", strings.TrimSpace(res.Body.String()))
+}
+
+type sharedQueue struct {
+	wd.Queue
+}
+
+func (sharedQueue) Shared() bool { return true }
+
+func Test_sharedQueuePending(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	done := env.Path("done")
+	queue := sharedQueue{Queue: wd.Unbound()}
+	script := wd.StaticScript(env.Path(env.Script("touch " + done)))
+	pusher := wd.New(wd.Config{Async: wd.AsyncModeForced, Queue: queue, Registerer: prometheus.NewRegistry()}, script)
+	worker := wd.New(wd.Config{Async: wd.AsyncModeForced, Queue: queue, Registerer: prometheus.NewRegistry()}, script)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go worker.Run(ctx)
+
+	res := httptest.NewRecorder()
+	pusher.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(done)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	require.NoError(t, pusher.Drain(drainCtx))
+	require.NoError(t, worker.Drain(drainCtx))
+	assert.Equal(t, int64(0), pusher.Pending())
+	assert.Equal(t, int64(0), worker.Pending())
+}
+
+// stoppingQueue stops worker right after item popped.
+type stoppingQueue struct {
+	wd.Queue
+	stop context.CancelFunc
+}
+
+func (q stoppingQueue) Pop(ctx context.Context) (*wd.QueuedWebhook, error) {
+	item, err := q.Queue.Pop(ctx)
+	q.stop()
+	return item, err
+}
+
+func Test_requeueAfterStop(t *testing.T) {
+	env := New()
+	defer env.Clear()
+
+	done := env.Path("done")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := wd.Unbound()
+	wh := wd.New(wd.Config{
+		Async:      wd.AsyncModeForced,
+		Queue:      stoppingQueue{Queue: queue, stop: cancel},
+		Registerer: prometheus.NewRegistry(),
+	}, wd.StaticScript(env.Path(env.Script("touch "+done))))
+
+	res := httptest.NewRecorder()
+	wh.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusAccepted, res.Code)
+
+	wh.Run(ctx)
+
+	_, err := os.Stat(done)
+	assert.True(t, os.IsNotExist(err), "not processed by stopped worker")
+	popCtx, popCancel := context.WithTimeout(context.Background(), time.Second)
+	defer popCancel()
+	item, err := queue.Pop(popCtx)
+	require.NoError(t, err, "item returned to queue")
+	assert.Equal(t, "/", item.Path)
+}
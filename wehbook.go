@@ -1,17 +1,29 @@
 package wd
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,7 +32,17 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
-const DefaultDelay = 3 * time.Second
+// StatusClientClosedRequest is non-standard status (nginx-style) for requests canceled by client before processing.
+const StatusClientClosedRequest = 499
+
+const (
+	DefaultDelay       = 3 * time.Second
+	DefaultHeadersSize = 8192 // maximum size of headers block in case buffering disabled
+	stderrTailSize     = 1024 // maximum size of stderr tail in logs for failed scripts
+)
+
+// outputTailSize is maximum size of async output tail for Config.IsSuccess.
+const outputTailSize = 64 * 1024
 
 type AsyncMode byte
 
@@ -33,8 +55,31 @@ const (
 	AsyncModeDisabled
 )
 
+// IOClass is IO scheduling class of scripts (Linux only, see ioprio_set(2)).
+type IOClass byte
+
+const (
+	IOClassDefault    IOClass = iota // inherited
+	IOClassRealtime                  // real-time, requires privileges
+	IOClassBestEffort                // best-effort
+	IOClassIdle                      // idle: IO only when no other process needs disk
+)
+
+// MaxNice is the lowest priority (maximum niceness) of scripts.
+const MaxNice = 19
+
+var (
+	DefaultSizeBuckets   = prometheus.ExponentialBuckets(256, 4, 8) // from 256B to 4MiB
+	DefaultTimingBuckets = prometheus.DefBuckets
+)
+
 var (
 	ErrUnprocessableFile = errors.New("stored request file unprocessable")
+	ErrInvalidWorkDir    = errors.New("invalid work dir")
+	ErrNoResources       = errors.New("not enough resources")
+	ErrRequestDeadline   = errors.New("request deadline exceeded")
+	ErrRunAsConflict     = errors.New("run as user (group) and run as file owner are mutually exclusive")
+	ErrBinaryBody        = errors.New("request body with NUL bytes can not be passed as argument or environment variable")
 )
 
 // ArgType defines how to pass request body to the executable.
@@ -50,9 +95,56 @@ const (
 	// ArgTypeEnv used to pass cached request body as string as environment variable ArgEnv. Do not use it for
 	// requests with payload more than ~2-3KB.
 	ArgTypeEnv
+	// ArgTypeFile used to store request body to temp file in work dir and pass path to the file as last parameter of
+	// command and as environment variable ArgFileEnv. File is accessible only by owner and removed after execution.
+	ArgTypeFile
+)
+
+// MultiValueEncoding defines how to pass repeated query params and headers to environment.
+type MultiValueEncoding byte
+
+const (
+	// MultiValueJoin joins all values by comma: QUERY_TAG=a,b. It's lossy for values with comma.
+	MultiValueJoin MultiValueEncoding = iota
+	// MultiValueIndexed additionally to joined values exposes each value by index starting from 0: QUERY_TAG=a,b,
+	// QUERY_TAG_0=a, QUERY_TAG_1=b.
+	MultiValueIndexed
+)
+
+// BinaryBody defines how to pass cached request body with bytes which can not be passed as argument or environment
+// variable (NUL) for ArgTypeParam and ArgTypeEnv. Other bytes (including newlines and =) are passed as-is.
+type BinaryBody byte
+
+const (
+	// BinaryBodyReject rejects requests with 400 Bad Request.
+	BinaryBodyReject BinaryBody = iota
+	// BinaryBodyBase64 passes body encoded by standard base64 and sets ArgEncodingEnv to base64.
+	BinaryBodyBase64
+)
+
+const (
+	DefaultHeaderPrefix = "HEADER_" // default prefix of environment variables for request headers
+	DefaultQueryPrefix  = "QUERY_"  // default prefix of environment variables for query params
+)
+
+const (
+	ArgEnv     = "REQUEST_BODY"      // Environment variable for ArgTypeEnv
+	ArgFileEnv = "REQUEST_BODY_FILE" // Environment variable for ArgTypeFile
+	// ArgEncodingEnv is environment variable with encoding (base64) of body for ArgTypeParam and ArgTypeEnv, set
+	// only if body is encoded (see BinaryBody)
+	ArgEncodingEnv = "REQUEST_BODY_ENCODING"
+)
+
+const (
+	// ExitCodeHeader contains exit code of script, if response was not sent before script finished (ex: buffered
+	// response or failed script).
+	ExitCodeHeader = "X-Exit-Code"
+	// ExitCodeSignaled reported instead of exit code for scripts terminated by signal (ex: killed by timeout).
+	ExitCodeSignaled = "signal"
 )
 
-const ArgEnv = "REQUEST_BODY" // Environment variable for ArgTypeEnv
+// DebugHeader in request (if Config.AllowDebug enabled) returns resolved command instead of execution. See DebugInfo.
+const DebugHeader = "X-WD-Debug"
 
 // Config for webhook daemon. All fields are completely optional.
 type Config struct {
@@ -62,25 +154,242 @@ type Config struct {
 	WorkDir        string                // location for scripts work dir. Acts as parent dir in case TempDir enabled. Also, in case TempDir enabled and WorkDir is empty - default system temp dir will be used
 	Timeout        time.Duration         // (can be overridden by xattrs) execution timeout. Zero or negative means no time limit
 	BufferSize     int                   // buffer response before reply. Zero means no buffering. It's soft limit.
+	MaxBufferSize  int                   // maximum buffer size which can be requested by client (query param buffer). Can not be less than BufferSize
+	BufferMemory   int64                 // total memory for buffers of all concurrent responses. If exhausted, responses are not buffered. Zero or negative means unlimited
 	Async          AsyncMode             // (can be overridden by xattrs) cache request into temp, returns 202 and process request in background
 	Retries        uint                  // (can be overridden by xattrs) number of additional retries after first attempt in case of async processing
 	Delay          time.Duration         // (can be overridden by xattrs) delay between retries for async processing. If delay is less or equal to 0, DefaultDelay will be used
 	Workers        int64                 // maximum amount of parallel sync requests. If it <= 0, 2 * NumCPU used
+	PathWorkers    int64                 // maximum amount of parallel sync requests per path. Zero or negative means no per-path limit
+	PerPathWorkers map[string]int64      // overrides PathWorkers for specific paths (ex: /report)
+	MaxConcurrent  int64                 // maximum amount of simultaneously running scripts across sync and async requests, applied in addition to Workers, PathWorkers and number of async workers. Zero or negative means unlimited
+	MaxSpooling    int64                 // maximum amount of async requests simultaneously serialized to QueueDir. Others wait. Zero or negative means unlimited
 	Registerer     prometheus.Registerer // prometheus registry. If not defined - new one will be used. Use prometheus.DefaultRegisterer to expose metrics globally
 	Queue          Queue                 // queue for async requests tasks. If not defined - Unbound used
+	QueueDir       string                // location for serialized async requests. Should be shared storage for shared queues. Empty means system temp dir
+	Codec          RequestCodec          // serializer of async requests. If not defined - WireCodec used
+	Tasks          TaskStore             // track statuses of async requests. Task ID is returned in X-Task-Id header and body. Not tracked if not defined
+	// path prefix of task status endpoint (ex: /_tasks/). If defined, Location header with task ID appended to the
+	// prefix is returned for tracked async requests (see Tasks)
+	TaskLocation string
+	// parse RFC822-style header block (terminated by blank line) from script output. Pseudo-header Status sets
+	// response code. If block not found within BufferSize (or DefaultHeadersSize if buffering disabled) - output used as-is
+	ParseScriptHeaders bool
+	// start in "starting" state: all requests will be rejected with 503 till MarkReady invoked
+	Starting bool
+	// handler for requests without matched script. If not defined - http.NotFound used
+	NotFoundHandler http.Handler
+	// do not pass request body for methods without meaningful body (GET, HEAD, DELETE, OPTIONS, TRACE) for
+	// ArgTypeParam and ArgTypeEnv: no empty argument and no empty environment variable
+	SkipBodylessPayload bool
+	// maximum size of request body in bytes for ArgTypeParam and ArgTypeEnv, which keep whole body in memory. Bigger
+	// requests are rejected with 413 Request Entity Too Large (by Content-Length before execution or while reading
+	// chunked body). Applied in addition to RequestSizeLimit middleware. Zero or negative means unlimited
+	MaxCachedBody int64
+	// how to pass cached body (ArgTypeParam and ArgTypeEnv) with NUL bytes. Default is BinaryBodyReject
+	BinaryBody BinaryBody
+	// search path (same format as PATH) for non-absolute commands. Also exported to scripts as PATH.
+	// Commands with path separators (ex: /usr/bin/echo or ./echo) are not affected. Relative directories
+	// (including empty entries and ".") are ignored. Empty means inherited PATH
+	ExecPath string
+	// discard buffered output of failed (ex: killed by timeout) scripts. By default, partial output buffered before
+	// failure will be sent with error status. Output already sent to client (exceeded BufferSize) can not be discarded
+	DiscardPartialOutput bool
+	// maximum number of active temp dirs (TempDir enabled). Zero or negative means unlimited
+	MaxTempDirs int64
+	// minimal free space in bytes on file system with temp dirs (TempDir enabled) required to create new temp dir.
+	// Zero means no check. Not supported on Windows
+	MinFreeSpace uint64
+	// (can be overridden by xattrs) maximum size of script output in bytes. Once exceeded, script will be terminated and
+	// response truncated (or 500 returned if nothing sent yet). Zero or negative means unlimited
+	MaxResponseSize int64
+	// maximum time of async request processing since it was enqueued (including time in queue, all attempts and delays
+	// between them). Once exceeded, remaining attempts are abandoned and request is marked as failed. Zero or negative
+	// means unlimited
+	MaxAsyncLifetime time.Duration
+	// (can be overridden by xattrs, Linux only) niceness and IO scheduling class of scripts. Negative niceness and
+	// real-time IO class require privileges (CAP_SYS_NICE). Zero values mean inherited from webhooks process
+	Nice    int
+	IOClass IOClass
+	// niceness increment for async executions (up to MaxNice), so background tasks do not starve sync requests
+	AsyncNice int
+	// (can be overridden by xattrs) how delay between async attempts changes. Default is constant Delay
+	Backoff BackoffStrategy
+	// (can be overridden by xattrs) URL which receives POST with JSON status (see TaskStatus) once async request is
+	// finished: succeeded or failed after all attempts. Delivery is retried limited number of times. Empty means disabled
+	CompletionCallback string
+	// decides whether async attempt succeeded (no retries) or failed (retry). Default is success if script exited
+	// with zero code
+	IsSuccess func(result ExecutionInfo) bool
+	// exit code of script which stops async retries (permanent failure). Zero means retry on any non-zero exit code
+	NoRetryExitCode int
+	// maximum delay before the next async attempt which can be requested by failed script by Retry-After header in
+	// seconds or HTTP date (requires ParseScriptHeaders) or by exiting with BackoffExitCode (maximum delay used). Zero
+	// or negative means such requests are ignored and Delay is always used
+	MaxRetryAfter time.Duration
+	// exit code of script which requests maximum delay (MaxRetryAfter) before the next async attempt. Zero means not used
+	BackoffExitCode int
+	// maximum ratio of async retries to successfully processed async requests per path (ex: 0.1 means retries can not
+	// exceed 10% of successes). Each path has small reserve of retries. Once budget exhausted, failed requests are not
+	// retried till successes replenish it. Zero or negative means unlimited retries
+	RetryBudget float64
+	// how to pass repeated query params and headers to environment. Default is comma-joined values
+	MultiValueEncoding MultiValueEncoding
+	// prefixes of environment variables for headers and query params. If not defined - DefaultHeaderPrefix and
+	// DefaultQueryPrefix used
+	HeaderPrefix string
+	QueryPrefix  string
+	// trusted reverse proxies. If direct peer is trusted, CLIENT_IP is the rightmost untrusted address from
+	// X-Forwarded-For header, otherwise - peer IP
+	TrustedProxies []netip.Prefix
+	// use X-Forwarded-Proto, X-Forwarded-Host (for REQUEST_SCHEME and REQUEST_HOST) and X-Real-IP (for CLIENT_IP if
+	// X-Forwarded-For not set) headers from TrustedProxies. Headers from untrusted peers are always ignored
+	TrustForwarded bool
+	// (posix only) run scripts as user (name or numeric ID) regardless of file owner, must be run as root. Temp dirs
+	// and payload files are owned by the user. Mutually exclusive with RunAsFileOwner
+	RunAsUser string
+	// (posix only) run scripts as group (name or numeric ID). If not defined - primary group of RunAsUser
+	RunAsGroup string
+	// (posix only) run scripts with only primary group for RunAsFileOwner and RunAsUser. By default, supplementary
+	// groups of the user are added as well
+	NoSupplementaryGroups bool
+	// pass verified TLS client certificate (PEM encoded) as CLIENT_CERT_PEM
+	ClientCertPEM bool
+	// reject (400 Bad Request) requests with query params which are not in AllowedQuery or in script specific list
+	// (Manifest.Query). Params used by webhooks itself (async, stream, buffer, timeout) are always allowed. In case
+	// both lists are empty, all params are allowed
+	StrictQuery  bool
+	AllowedQuery []string
+	// do not pass headers and (or) query params to environment. REQUEST_PATH, REQUEST_METHOD and CLIENT_ADDR are
+	// passed anyway
+	DisableHeadersEnv bool
+	DisableQueryEnv   bool
+	// pass to environment only headers with canonical name (ex: X-Github-Event) matched by pattern (use (?i) for
+	// case-insensitive match). Applied in addition to DisableHeadersEnv. X-Attempt is passed anyway. If not defined -
+	// all headers are passed
+	HeaderEnvPattern *regexp.Regexp
+	// buckets for histograms of request payload and response sizes in bytes. If not defined - DefaultSizeBuckets used
+	PayloadBuckets  []float64
+	ResponseBuckets []float64
+	// buckets for histogram of requests processing time in seconds. If not defined - DefaultTimingBuckets used
+	TimingBuckets []float64
+	// interval to send partial output (including buffered) to client for slow streaming scripts. Headers are sent with
+	// first flushed data. Zero means no periodic flushes
+	FlushInterval time.Duration
+	// logger for webhooks events. If not defined - slog.Default() used
+	Logger *slog.Logger
+	// returns trace ID of request (ex: TraceParentID) which is attached as exemplar (trace_id label) to histograms
+	// observations. Exemplars are exposed only in OpenMetrics format. If not defined or returned empty string -
+	// exemplars are not used
+	TraceID func(req *http.Request) string
+	// maps request path to value of path label in metrics, for example to collapse /user/123 to /user/:id and limit
+	// cardinality for dynamic routes (see PathPatterns). If not defined - path used as-is
+	MetricsPath func(path string) string
+	// requests with DebugHeader will not be executed: resolved command, environment, work dir and manifest will be
+	// returned as JSON (see DebugInfo). Debug requests are always synchronous. Access to such requests should be
+	// restricted by caller
+	AllowDebug bool
+	// record only class of errors (ex: exit status 1, request deadline exceeded) in LastErrors instead of full messages,
+	// which may contain paths and details of environment
+	RedactErrors bool
+	// secrets for verifying signature of per-request manifest override (see ManifestHeader). Empty means overrides
+	// are ignored
+	ManifestSecrets [][]byte
+	// store of idempotency keys (see IdempotencyKeyHeader). Duplicated requests with the same key and path are not
+	// executed: status code of the first request (and task ID for async requests) is returned with
+	// IdempotentReplayedHeader, or 409 Conflict if the first request is still in progress. Keys are released if request
+	// has not been executed (ex: canceled while waiting for worker). Deduplication disabled if not defined
+	Idempotency IdempotencyStore
+	// time to remember idempotency keys. If not defined - DefaultIdempotencyTTL used
+	IdempotencyTTL time.Duration
+	// maximum lifetime of request handling including waiting for workers, reading body and sending response,
+	// unlike Timeout which limits only script execution. Once exceeded, 504 Gateway Timeout is returned (if response
+	// not sent yet) with ErrRequestDeadline in X-Error header. Zero or negative means unlimited
+	RequestDeadline time.Duration
+	// (can be overridden by xattrs) maximum rate of requests per path (and per RateLimitKey if defined). Requests
+	// exceeding the limit (sync and async) are rejected with 429 Too Many Requests and Retry-After header. Zero
+	// means unlimited
+	RateLimit RateLimit
+	// rate limit per client IP (see CLIENT_IP), so each client has own limit per path
+	RateLimitPerClient bool
+	// additional key of rate limit (ex: authenticated subject), so each key has own limit per path. If not defined and
+	// RateLimitPerClient not set - the limit is shared by all clients
+	RateLimitKey func(req *http.Request) string
+	// state of rate limits. If not defined - NewMemoryRateLimiter used
+	RateLimiter RateLimiter
+	// number of async workers (see Run) started by New. Such workers are stopped by Close. Zero or negative means
+	// workers should be started manually
+	AutoStartWorkers int
+	// parent context of workers started by New (see AutoStartWorkers). If not defined - context.Background() used
+	WorkersContext context.Context
+}
+
+// DebugInfo describes how script would be executed. Environment contains only variables defined by webhooks
+// (inherited environment is not included).
+type DebugInfo struct {
+	Command  []string `json:"command"`
+	Env      []string `json:"env"`
+	WorkDir  string   `json:"work_dir"`
+	Manifest Manifest `json:"manifest"`
+}
+
+// ErrNotSuccess returned for async attempts rejected by Config.IsSuccess.
+var ErrNotSuccess = errors.New("attempt not accepted as success")
+
+// ExecutionInfo is result of async attempt for Config.IsSuccess.
+type ExecutionInfo struct {
+	Path     string
+	Attempt  uint          // attempt number starting from 1
+	ExitCode int           // exit code of script; -1 if script terminated by signal or not started
+	Status   int           // status code set by script headers (see Config.ParseScriptHeaders), zero if not set
+	Headers  http.Header   // headers set by script (see Config.ParseScriptHeaders)
+	Output   []byte        // tail of script output (up to 64KiB)
+	Duration time.Duration // execution time
+	Err      error         // execution error, nil if script exited with zero code
 }
 
 type Webhooks struct {
 	config      Config
+	ready       int32 // 1 if ready to serve requests
+	draining    int32 // 1 if new requests rejected (see MarkDraining)
+	pending     int64 // number of tasks pushed to queue, but not yet picked by workers
+	processing  int64 // number of async tasks in progress
+	tempDirs    int64 // number of active temp dirs
 	runner      Runner
 	queue       Queue
+	sharedQueue bool // queue is shared between instances, so pending tasks are not tracked
+	runAs       *internal.Credential
+	runAsErr    error
 	syncWorkers *semaphore.Weighted
+	pathWorkers *pathLimiter
+	buffers     *semaphore.Weighted // memory for buffered responses, nil means unlimited
+	running     *semaphore.Weighted // running scripts across sync and async requests, nil means unlimited
+	spooling    *semaphore.Weighted // async requests being serialized, nil means unlimited
+	retries     *retryBudget        // async retries per path, nil means unlimited
+	lastErrors  *lastErrors
+	stopWorkers context.CancelFunc // stops workers started by New, nil if not started
+	workers     sync.WaitGroup     // workers started by New
 	// metrics
-	workersNum   prometheus.Gauge // number of go-routines running Run() (processing async requests)
+	workersNum   prometheus.Gauge     // number of go-routines running Run() (processing async requests)
+	busyWorkers  *prometheus.GaugeVec // number of sync requests in progress
+	runningNum   prometheus.Gauge     // number of running scripts (sync and async)
 	requestsNum  *prometheus.CounterVec
 	requestsTime *prometheus.CounterVec
 	trafficIn    *prometheus.CounterVec // input traffic
 	trafficOut   *prometheus.CounterVec // output traffic
+	payloadSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	timing       *prometheus.HistogramVec
+	canceledNum  *prometheus.CounterVec // requests canceled by client while waiting for sync worker
+	truncatedNum *prometheus.CounterVec // responses truncated due to output limit
+	pushCanceled *prometheus.CounterVec // async requests canceled by client while pushing to queue
+	exitCodes    *prometheus.CounterVec // finished scripts by exit code
+	asyncFailed  *prometheus.CounterVec // async requests failed after all attempts
+	asyncSuccess *prometheus.CounterVec // successfully processed async requests
+	replayedNum  *prometheus.CounterVec // duplicated requests by idempotency key
+	rateLimited  *prometheus.CounterVec // requests rejected by rate limit
+	queueWait    prometheus.Histogram   // time between enqueue and pick by worker
+	budgetSpent  *prometheus.CounterVec // async requests not retried due to exhausted retry budget
 
 	queuedNum          prometheus.Gauge
 	processingNum      prometheus.Gauge
@@ -93,19 +402,27 @@ type Webhooks struct {
 // Converts headers to HEADER_<capital snake case> environment, converts query params to QUERY_<capital snake case>
 // environment variables. For example:
 //
-//      HEADER_CONTENT_TYPE
-//      QUERY_PAGE
+//	HEADER_CONTENT_TYPE
+//	QUERY_PAGE
+//
+// Prefixes can be changed by HeaderPrefix and QueryPrefix, mapping can be disabled by DisableHeadersEnv and
+// DisableQueryEnv.
 //
-// Additionally passed: REQUEST_PATH, REQUEST_METHOD, CLIENT_ADDR (remote IP:port of incoming connection; not including X-Forwarded-For)
+// Additionally passed: REQUEST_PATH, REQUEST_METHOD, CLIENT_ADDR (remote IP:port of incoming connection; not including X-Forwarded-For),
+// CLIENT_IP (client IP, respecting X-Forwarded-For from TrustedProxies), REQUEST_SCHEME and REQUEST_HOST (original
+// scheme and host, respecting forwarded headers, see TrustForwarded), CLIENT_CERT_CN, CLIENT_CERT_SAN,
+// CLIENT_CERT_SERIAL and CLIENT_CERT_PEM (see ClientCertPEM) - only for verified TLS client certificates.
 //
-// Special parameter for ArgType env - REQUEST_PAYLOAD.
+// Special parameter for ArgType env - REQUEST_PAYLOAD, for ArgType file - REQUEST_BODY_FILE.
 //
 // In case request marked as async, request will be serialized to file, name of file will be pushed to queue.
 // Workers (go-routines invoked Run) will pickup file name and will start stream request from file transparently for upstream.
 //
-// Special header X-Attempt will be added to the request. Attempt is number, starting from 1.
+// Special header X-Attempt will be added to the request. Attempt is number, starting from 1. Sync requests
+// always have attempt 1 unless header already defined.
 //
-// To start async processing, the Run should be invoked.
+// To start async processing, the Run should be invoked (or workers should be started by New, see
+// Config.AutoStartWorkers).
 func New(config Config, runner Runner) *Webhooks {
 	if config.Workers <= 0 {
 		config.Workers = int64(2 * runtime.NumCPU())
@@ -116,6 +433,33 @@ func New(config Config, runner Runner) *Webhooks {
 	if config.Delay <= 0 {
 		config.Delay = DefaultDelay
 	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.RateLimiter == nil {
+		config.RateLimiter = NewMemoryRateLimiter()
+	}
+	if config.IdempotencyTTL <= 0 {
+		config.IdempotencyTTL = DefaultIdempotencyTTL
+	}
+	if config.Codec == nil {
+		config.Codec = WireCodec{}
+	}
+	if config.HeaderPrefix == "" {
+		config.HeaderPrefix = DefaultHeaderPrefix
+	}
+	if config.QueryPrefix == "" {
+		config.QueryPrefix = DefaultQueryPrefix
+	}
+	if len(config.PayloadBuckets) == 0 {
+		config.PayloadBuckets = DefaultSizeBuckets
+	}
+	if len(config.ResponseBuckets) == 0 {
+		config.ResponseBuckets = DefaultSizeBuckets
+	}
+	if len(config.TimingBuckets) == 0 {
+		config.TimingBuckets = DefaultTimingBuckets
+	}
 
 	registry := config.Registerer
 	if registry == nil {
@@ -124,17 +468,67 @@ func New(config Config, runner Runner) *Webhooks {
 
 	factory := promauto.With(registry)
 
-	return &Webhooks{
+	var ready int32 = 1
+	if config.Starting {
+		ready = 0
+	}
+
+	var runAs *internal.Credential
+	var runAsErr error
+	if config.RunAsUser != "" || config.RunAsGroup != "" {
+		if config.RunAsFileOwner {
+			runAsErr = ErrRunAsConflict
+		} else if runAs, runAsErr = internal.LookupCredential(config.RunAsUser, config.RunAsGroup); runAsErr != nil {
+			runAsErr = fmt.Errorf("run as %s:%s: %w", config.RunAsUser, config.RunAsGroup, runAsErr)
+		}
+	}
+
+	var buffers *semaphore.Weighted
+	if config.BufferMemory > 0 {
+		buffers = semaphore.NewWeighted(config.BufferMemory)
+	}
+
+	var running *semaphore.Weighted
+	if config.MaxConcurrent > 0 {
+		running = semaphore.NewWeighted(config.MaxConcurrent)
+	}
+
+	var spooling *semaphore.Weighted
+	if config.MaxSpooling > 0 {
+		spooling = semaphore.NewWeighted(config.MaxSpooling)
+	}
+
+	wh := &Webhooks{
 		config:      config,
+		ready:       ready,
+		runAs:       runAs,
+		runAsErr:    runAsErr,
 		runner:      runner,
 		syncWorkers: semaphore.NewWeighted(config.Workers),
+		pathWorkers: newPathLimiter(config.PathWorkers, config.PerPathWorkers),
+		buffers:     buffers,
+		running:     running,
+		spooling:    spooling,
+		retries:     newRetryBudget(config.RetryBudget),
+		lastErrors:  newLastErrors(maxLastErrors, config.RedactErrors),
 		queue:       config.Queue,
+		sharedQueue: isSharedQueue(config.Queue),
 
 		workersNum: factory.NewGauge(prometheus.GaugeOpts{
 			Namespace: "webhooks",
 			Name:      "workers",
 			Help:      "current number of workers",
 		}),
+		busyWorkers: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "webhooks",
+			Name:      "busy",
+			Help:      "current number of sync requests in progress",
+		}, []string{"path"}),
+		runningNum: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: "webhooks",
+			Name:      "running",
+			Help:      "current number of running scripts (sync and async)",
+		}),
 		requestsNum: factory.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "webhooks",
 			Name:      "requests",
@@ -160,6 +554,80 @@ func New(config Config, runner Runner) *Webhooks {
 			Name:      "waiting",
 			Help:      "number of items waiting for retry",
 		}),
+		canceledNum: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Name:      "canceled",
+			Help:      "total number of requests canceled while waiting for sync worker",
+		}, []string{"path"}),
+		pushCanceled: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Subsystem: "queue",
+			Name:      "push_canceled",
+			Help:      "total number of async requests canceled by client while waiting for space in queue",
+		}, []string{"path"}),
+		truncatedNum: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Name:      "truncated",
+			Help:      "total number of responses truncated due to output limit",
+		}, []string{"path"}),
+		exitCodes: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Name:      "exit_codes_total",
+			Help:      "total number of finished scripts by exit code",
+		}, []string{"path", "code"}),
+		asyncFailed: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Subsystem: "async",
+			Name:      "failures",
+			Help:      "total number of async requests failed after all attempts",
+		}, []string{"path"}),
+		asyncSuccess: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Subsystem: "async",
+			Name:      "successes",
+			Help:      "total number of successfully processed async requests",
+		}, []string{"path"}),
+		queueWait: factory.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "webhooks",
+			Subsystem: "queue",
+			Name:      "wait_seconds",
+			Help:      "time async requests wait in queue till picked by worker",
+			Buckets:   config.TimingBuckets,
+		}),
+		rateLimited: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Name:      "rate_limited",
+			Help:      "total number of requests rejected due to rate limit",
+		}, []string{"path"}),
+		replayedNum: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Name:      "replayed",
+			Help:      "total number of duplicated requests (by idempotency key) which were not executed",
+		}, []string{"path"}),
+		budgetSpent: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "webhooks",
+			Subsystem: "async",
+			Name:      "retry_budget_exhausted",
+			Help:      "total number of failed async requests not retried due to exhausted retry budget",
+		}, []string{"path"}),
+		payloadSize: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "webhooks",
+			Name:      "payload",
+			Help:      "size of requests payload in bytes",
+			Buckets:   config.PayloadBuckets,
+		}, []string{"path"}),
+		responseSize: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "webhooks",
+			Name:      "response",
+			Help:      "size of responses in bytes",
+			Buckets:   config.ResponseBuckets,
+		}, []string{"path"}),
+		timing: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "webhooks",
+			Name:      "timing",
+			Help:      "requests processing time in seconds",
+			Buckets:   config.TimingBuckets,
+		}, []string{"path", "async"}),
 		trafficIn: factory.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "webhooks",
 			Subsystem: "traffic",
@@ -173,186 +641,762 @@ func New(config Config, runner Runner) *Webhooks {
 			Help:      "total outgoing traffic in bytes",
 		}, []string{"path"}),
 	}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "webhooks",
+		Subsystem: "queue",
+		Name:      "oldest_age_seconds",
+		Help:      "age of the oldest async request in queue, zero if queue is empty",
+	}, wh.oldestQueued)
+	wh.startWorkers()
+	return wh
+}
+
+// LastErrors returns last error of script execution for each path (limited number of paths). Errors are redacted if
+// Config.RedactErrors set.
+func (wh *Webhooks) LastErrors() map[string]PathError {
+	return wh.lastErrors.Snapshot()
+}
+
+// MarkReady switches webhooks from "starting" state (see Config.Starting) to normal processing.
+func (wh *Webhooks) MarkReady() {
+	atomic.StoreInt32(&wh.ready, 1)
+}
+
+// IsReady returns true if webhooks are ready to serve requests: not in "starting" state and not draining.
+func (wh *Webhooks) IsReady() bool {
+	return atomic.LoadInt32(&wh.ready) == 1 && !wh.IsDraining()
+}
+
+// MarkDraining switches webhooks to "draining" state during shutdown: new requests are rejected with 503 and
+// Retry-After header, so clients can retry on another instance, while in-flight requests and queued async requests
+// are processed as usual (see Drain). There is no way back.
+func (wh *Webhooks) MarkDraining() {
+	atomic.StoreInt32(&wh.draining, 1)
+}
+
+// IsDraining returns true if webhooks are in "draining" state (see MarkDraining).
+func (wh *Webhooks) IsDraining() bool {
+	return atomic.LoadInt32(&wh.draining) == 1
 }
 
 func (wh *Webhooks) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	started := time.Now()
 
+	if wh.IsDraining() {
+		writer.Header().Set("Retry-After", "1")
+		writer.Header().Set("Connection", "close")
+		http.Error(writer, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !wh.IsReady() {
+		writer.Header().Set("Retry-After", "1")
+		http.Error(writer, "starting", http.StatusServiceUnavailable)
+		return
+	}
+
+	// limit total lifetime of request (see RequestDeadline)
+	if wh.config.RequestDeadline > 0 {
+		ctx, cancel := context.WithTimeoutCause(req.Context(), wh.config.RequestDeadline, ErrRequestDeadline)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
 	// get manifest or return 404
-	manifest := wh.runner.Command(req, wh.defaultManifest())
+	manifest := wh.runner.Command(req, wh.requestManifest(req))
 	if manifest == nil {
-		http.NotFound(writer, req)
+		wh.notFound(writer, req)
+		return
+	}
+	if !manifest.IsMethodAllowed(req.Method) {
+		writer.Header().Set("Allow", strings.Join(manifest.Methods, ", "))
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if param, ok := wh.checkQuery(manifest, req); !ok {
+		http.Error(writer, "unexpected query param: "+param, http.StatusBadRequest)
+		return
+	}
+	if wh.isCachedBodyTooBig(req) {
+		http.Error(writer, ErrTooBigRequest.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !wh.checkRateLimit(writer, req, manifest) {
 		return
 	}
-	isAsync := wh.isAsyncRequest(manifest.Async, req)
+	wh.applyTimeoutHint(manifest, req)
+	isAsync := wh.isAsyncRequest(manifest.Async, req) && !wh.isDebugRequest(req)
 
-	log.Printf("manifest: %+v, async: %v", manifest, isAsync)
+	wh.config.Logger.Debug("manifest", "path", req.URL.Path, "manifest", manifest, "async", isAsync)
 
 	// count input size
-	meter := internal.NewMeteredStream(req.Body)
+	meter := &internal.Counter{}
 	defer func() {
-		wh.trafficIn.WithLabelValues(req.URL.Path).Add(float64(meter.Total()))
+		wh.trafficIn.WithLabelValues(wh.metricsPath(req.URL.Path)).Add(float64(meter.Total()))
 	}()
 
-	req.Body = meter
+	req.Body = internal.NewSinkReader(req.Body, meter)
 
 	// buffered response
-	response := internal.NewBufferedStream(writer, wh.config.BufferSize)
+	bufferSize := wh.bufferSize(req)
+	if bufferSize > 0 && wh.buffers != nil {
+		if wh.buffers.TryAcquire(int64(bufferSize)) {
+			defer wh.buffers.Release(int64(bufferSize))
+		} else {
+			wh.config.Logger.Debug("buffers memory exhausted, response will not be buffered", "path", req.URL.Path)
+			bufferSize = 0
+		}
+	}
+	response := internal.NewBufferedStream(writer, bufferSize)
 
 	writer = response
 
 	// save metrics
 	defer func() {
 		wh.requestsTime.WithLabelValues(
-			req.URL.Path,
+			wh.metricsPath(req.URL.Path),
 			strconv.Itoa(response.StatusCode()),
 			strconv.FormatBool(isAsync),
 		).Add(time.Since(started).Seconds())
-		wh.trafficOut.WithLabelValues(req.URL.Path).Add(float64(response.Total()))
+		wh.trafficOut.WithLabelValues(wh.metricsPath(req.URL.Path)).Add(float64(response.Total()))
+		traceID := wh.traceID(req)
+		observe(wh.payloadSize.WithLabelValues(wh.metricsPath(req.URL.Path)), float64(meter.Total()), traceID)
+		observe(wh.responseSize.WithLabelValues(wh.metricsPath(req.URL.Path)), float64(response.Total()), traceID)
+		observe(wh.timing.WithLabelValues(wh.metricsPath(req.URL.Path), strconv.FormatBool(isAsync)), time.Since(started).Seconds(), traceID)
+		wh.config.Logger.Info("request processed",
+			"path", req.URL.Path,
+			"status", response.StatusCode(),
+			"async", isAsync,
+			"duration", time.Since(started))
 	}()
 
-	defer response.Flush()
+	// deduplicate retried requests
+	idempotencyKey, replayed := wh.reserveIdempotencyKey(writer, req)
+	var dispatched bool // executed or enqueued
+	if idempotencyKey != "" {
+		// deferred before Finish, so status of buffered response is already set
+		defer func() {
+			wh.completeIdempotencyKey(idempotencyKey, dispatched, response.StatusCode(), response.Header().Get("X-Task-Id"))
+		}()
+	}
+
+	defer response.Finish()
+
+	if replayed {
+		return
+	}
 
-	wh.requestsNum.WithLabelValues(req.URL.Path, strconv.FormatBool(isAsync)).Inc()
+	wh.requestsNum.WithLabelValues(wh.metricsPath(req.URL.Path), strconv.FormatBool(isAsync)).Inc()
 
 	if isAsync {
-		if err := wh.enqueueWebhook(req, manifest); err != nil {
-			log.Println("failed enqueue task:", err)
+		taskID, err := wh.enqueueWebhook(req, manifest)
+		if err != nil && isRequestDeadline(req) {
+			wh.requestDeadlineExceeded(writer, req)
+			return
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			// client gone while waiting for space in queue - not a server error
+			wh.config.Logger.Warn("request canceled while pushing to queue", "path", req.URL.Path, "error", err)
+			wh.pushCanceled.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+			writer.WriteHeader(StatusClientClosedRequest)
+			return
+		} else if err != nil {
+			wh.config.Logger.Error("failed enqueue task", "path", req.URL.Path, "error", err)
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		dispatched = true
+		if taskID != "" {
+			writer.Header().Set("X-Task-Id", taskID)
+			if wh.config.TaskLocation != "" {
+				writer.Header().Set("Location", wh.config.TaskLocation+taskID)
+			}
+			writer.WriteHeader(http.StatusAccepted)
+			_, _ = writer.Write([]byte(taskID))
+			return
+		}
 		writer.WriteHeader(http.StatusAccepted)
 		return
 	}
 
+	// limit number of maximum sync webhooks per path to prevent starvation of other paths
+	releasePath, err := wh.pathWorkers.Acquire(req.Context(), req.URL.Path)
+	if errors.Is(err, context.Canceled) {
+		wh.config.Logger.Warn("request canceled while waiting for path worker", "path", req.URL.Path)
+		wh.canceledNum.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+		writer.WriteHeader(StatusClientClosedRequest)
+		return
+	} else if err != nil && isRequestDeadline(req) {
+		wh.requestDeadlineExceeded(writer, req)
+		return
+	} else if err != nil {
+		wh.config.Logger.Error("failed acquire path worker", "path", req.URL.Path, "error", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer releasePath()
+
 	// limit number of maximum sync webhooks to prevent overload system
-	if err := wh.syncWorkers.Acquire(req.Context(), 1); err != nil {
-		log.Println("failed acquire sync worker: %w", err)
+	if err := wh.syncWorkers.Acquire(req.Context(), 1); errors.Is(err, context.Canceled) {
+		wh.config.Logger.Warn("request canceled while waiting for sync worker", "path", req.URL.Path)
+		wh.canceledNum.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+		writer.WriteHeader(StatusClientClosedRequest)
+		return
+	} else if err != nil && isRequestDeadline(req) {
+		wh.requestDeadlineExceeded(writer, req)
+		return
+	} else if err != nil {
+		wh.config.Logger.Error("failed acquire sync worker", "path", req.URL.Path, "error", err)
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer wh.syncWorkers.Release(1)
 
-	err := wh.invokeWebhook(response, req, manifest)
+	// limit total number of running scripts across sync and async requests
+	releaseRunning, err := wh.acquireRunning(req.Context())
+	if errors.Is(err, context.Canceled) {
+		wh.config.Logger.Warn("request canceled while waiting for execution slot", "path", req.URL.Path)
+		wh.canceledNum.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+		writer.WriteHeader(StatusClientClosedRequest)
+		return
+	} else if err != nil && isRequestDeadline(req) {
+		wh.requestDeadlineExceeded(writer, req)
+		return
+	} else if err != nil {
+		wh.config.Logger.Error("failed acquire execution slot", "path", req.URL.Path, "error", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer releaseRunning()
+
+	busy := wh.busyWorkers.WithLabelValues(wh.metricsPath(req.URL.Path))
+	busy.Inc()
+	defer busy.Dec()
+
+	dispatched = true
+	err = wh.invokeWebhook(response, req, manifest)
 	if err == nil {
 		return
 	}
+	if isRequestDeadline(req) {
+		// distinguish slow request (ex: slow I/O) from slow script (see Timeout)
+		err = fmt.Errorf("%w: %v", ErrRequestDeadline, err)
+	}
+	wh.lastErrors.Record(req.URL.Path, err)
 
 	var status = http.StatusBadGateway
 
-	if errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrRequestDeadline) {
 		status = http.StatusGatewayTimeout
 	} else if errors.Is(err, os.ErrNotExist) {
 		status = http.StatusNotFound
+	} else if errors.Is(err, ErrTooBigResponse) || errors.Is(err, ErrInvalidWorkDir) {
+		status = http.StatusInternalServerError
+	} else if errors.Is(err, ErrTooBigRequest) {
+		status = http.StatusRequestEntityTooLarge
+	} else if errors.Is(err, ErrBinaryBody) {
+		status = http.StatusBadRequest
+	} else if errors.Is(err, ErrNoResources) {
+		status = http.StatusServiceUnavailable
 	}
 
-	log.Println("failed run webhook:", err)
+	wh.config.Logger.Error("failed run webhook", "path", req.URL.Path, "status", status, "error", err)
 	if !response.HeadersSent() {
+		if wh.config.DiscardPartialOutput {
+			if discarded := response.Discard(); discarded > 0 {
+				wh.config.Logger.Info("discarded partial output", "path", req.URL.Path, "size", discarded)
+			}
+		}
 		response.Header().Set("X-Error", err.Error())
 		response.WriteHeader(status)
 	}
 }
 
+// isRequestDeadline returns true if request lifetime exceeded (see Config.RequestDeadline).
+func isRequestDeadline(req *http.Request) bool {
+	return errors.Is(context.Cause(req.Context()), ErrRequestDeadline)
+}
+
+// requestDeadlineExceeded replies with 504 Gateway Timeout and ErrRequestDeadline in X-Error header.
+func (wh *Webhooks) requestDeadlineExceeded(writer http.ResponseWriter, req *http.Request) {
+	wh.config.Logger.Warn("request deadline exceeded before execution", "path", req.URL.Path, "deadline", wh.config.RequestDeadline)
+	writer.Header().Set("X-Error", ErrRequestDeadline.Error())
+	http.Error(writer, ErrRequestDeadline.Error(), http.StatusGatewayTimeout)
+}
+
+// acquireRunning acquires slot for script execution (see Config.MaxConcurrent). Returned function must be called to
+// release slot in case of no errors.
+func (wh *Webhooks) acquireRunning(ctx context.Context) (func(), error) {
+	if wh.running != nil {
+		if err := wh.running.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+	}
+	wh.runningNum.Inc()
+	return func() {
+		wh.runningNum.Dec()
+		if wh.running != nil {
+			wh.running.Release(1)
+		}
+	}, nil
+}
+
 func (wh *Webhooks) invokeWebhook(writer http.ResponseWriter, req *http.Request, manifest *Manifest) error {
 	ctx := req.Context()
-	if wh.config.Timeout > 0 {
-		tCtx, cancel := context.WithTimeout(ctx, wh.config.Timeout)
+	if manifest.Timeout > 0 {
+		tCtx, cancel := context.WithTimeout(ctx, manifest.Timeout)
 		defer cancel()
 		ctx = tCtx
 	}
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
 
-	// create temp dir
-	workDir, err := wh.tempDir(manifest.Binary())
-	if errors.Is(err, os.ErrNotExist) {
-		http.NotFound(writer, req)
-		return err
-	} else if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		log.Println("failed to create temp dir:", err)
+	var workDir = manifest.WorkDir
+	if workDir != "" {
+		// script specific work dir
+		if info, err := os.Stat(workDir); err != nil {
+			return fmt.Errorf("%w %s: %v", ErrInvalidWorkDir, workDir, err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("%w %s: not a directory", ErrInvalidWorkDir, workDir)
+		}
+	} else {
+		// create temp dir
+		tmpDir, err := wh.tempDir(manifest.Binary())
+		if errors.Is(err, os.ErrNotExist) {
+			wh.notFound(writer, req)
+			return err
+		} else if errors.Is(err, ErrNoResources) {
+			return err
+		} else if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			wh.config.Logger.Error("failed to create temp dir", "path", req.URL.Path, "error", err)
+			return err
+		}
+		defer wh.cleanupTempDir(tmpDir)
+		workDir = tmpDir
+	}
+
+	binary, err := wh.lookPath(manifest.Binary())
+	if err != nil {
 		return err
 	}
-	defer wh.cleanupTempDir(workDir)
 
-	cmd := exec.CommandContext(ctx, manifest.Binary(), manifest.Args()...)
+	cmd := exec.CommandContext(ctx, binary, manifest.Args()...)
 	cmd.Dir = workDir
 	cmd.Stdout = writer
+	if wh.config.ParseScriptHeaders {
+		headersParser := internal.NewHeaderParser(writer, wh.headersLimit())
+		defer headersParser.Close()
+		cmd.Stdout = headersParser
+	}
+	var limiter *responseLimiter
+	if manifest.MaxResponse > 0 {
+		limiter = &responseLimiter{
+			maxSize: manifest.MaxResponse,
+			abort:   abort,
+			writer:  cmd.Stdout,
+		}
+		cmd.Stdout = limiter
+	}
+	if req.Header.Get("X-Attempt") == "" {
+		// sync request - the only attempt
+		req.Header.Set("X-Attempt", "1")
+	}
 	cmd.Env = os.Environ()
+	inherited := len(cmd.Env)
+	if wh.config.ExecPath != "" {
+		cmd.Env = append(cmd.Env, "PATH="+wh.config.ExecPath)
+	}
 	// map headers to env
-	for k, v := range req.Header {
-		cmd.Env = append(cmd.Env, "HEADER_"+toEnv(k)+"="+strings.Join(v, ","))
+	if !wh.config.DisableHeadersEnv {
+		for k, v := range req.Header {
+			if !wh.isHeaderExported(k) {
+				continue
+			}
+			cmd.Env = wh.appendValues(cmd.Env, wh.config.HeaderPrefix+toEnv(k), v)
+		}
 	}
 	// map query to env
-	for k, v := range req.URL.Query() {
-		cmd.Env = append(cmd.Env, "QUERY_"+toEnv(k)+"="+strings.Join(v, ","))
+	if !wh.config.DisableQueryEnv {
+		for k, v := range req.URL.Query() {
+			cmd.Env = wh.appendValues(cmd.Env, wh.config.QueryPrefix+toEnv(k), v)
+		}
 	}
+	// script specific env
+	cmd.Env = append(cmd.Env, manifest.Env...)
 	// add special env vars
 	cmd.Env = append(cmd.Env,
 		"REQUEST_PATH="+req.URL.Path,
 		"REQUEST_METHOD="+req.Method,
-		"CLIENT_ADDR="+req.RemoteAddr)
+		"CLIENT_ADDR="+req.RemoteAddr,
+		"CLIENT_IP="+wh.clientIP(req),
+		"REQUEST_SCHEME="+wh.requestScheme(req),
+		"REQUEST_HOST="+wh.requestHost(req))
+	cmd.Env = wh.appendClientCert(cmd.Env, req)
 	// if applicable - run as owner of the script
 	if err := wh.setRunCredentials(cmd, manifest.Binary()); err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		log.Println("failed set credentials based on file:", err)
+		wh.config.Logger.Error("failed set credentials", "path", req.URL.Path, "error", err)
 		return err
 	}
+	skipPayload := wh.config.SkipBodylessPayload && isBodyless(req.Method)
 	// read body to var if arg type is env or arg, otherwise pipe to STDIN
 	var requestBody string
-	if wh.config.ArgType.IsCachingType() {
-		data, err := ioutil.ReadAll(req.Body)
-		if err != nil {
+	if wh.config.ArgType.IsCachingType() && !skipPayload {
+		data, err := wh.readCachedBody(req.Body)
+		if errors.Is(err, ErrTooBigRequest) {
+			http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+			wh.config.Logger.Error("failed read request body", "path", req.URL.Path, "error", err)
+			return err
+		} else if err != nil {
 			http.Error(writer, err.Error(), http.StatusBadRequest)
-			log.Println("failed read request body:", err)
+			wh.config.Logger.Error("failed read request body", "path", req.URL.Path, "error", err)
 			return err
 		}
-		requestBody = string(data)
+		if bytes.IndexByte(data, 0) < 0 {
+			requestBody = string(data)
+		} else if wh.config.BinaryBody == BinaryBodyBase64 {
+			requestBody = base64.StdEncoding.EncodeToString(data)
+			cmd.Env = append(cmd.Env, ArgEncodingEnv+"=base64")
+		} else {
+			http.Error(writer, ErrBinaryBody.Error(), http.StatusBadRequest)
+			wh.config.Logger.Error("failed pass request body", "path", req.URL.Path, "error", ErrBinaryBody)
+			return ErrBinaryBody
+		}
 	}
 
 	switch wh.config.ArgType {
 	case ArgTypeParam:
-		cmd.Args = append(cmd.Args, requestBody)
+		if !skipPayload {
+			cmd.Args = append(cmd.Args, requestBody)
+		}
 	case ArgTypeEnv:
-		cmd.Env = append(cmd.Env, ArgEnv+"="+requestBody)
+		if !skipPayload {
+			cmd.Env = append(cmd.Env, ArgEnv+"="+requestBody)
+		}
+	case ArgTypeFile:
+		if !skipPayload {
+			payloadFile, err := wh.payloadFile(workDir, manifest.Binary(), req.Body)
+			if errors.Is(err, ErrTooBigRequest) {
+				http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+				wh.config.Logger.Error("failed store request body", "path", req.URL.Path, "error", err)
+				return err
+			} else if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				wh.config.Logger.Error("failed store request body", "path", req.URL.Path, "error", err)
+				return err
+			}
+			defer os.Remove(payloadFile)
+			cmd.Args = append(cmd.Args, payloadFile)
+			cmd.Env = append(cmd.Env, ArgFileEnv+"="+payloadFile)
+		}
 	case ArgTypeStdin:
 		fallthrough
 	default:
 		cmd.Stdin = req.Body
 	}
 
-	return cmd.Run()
+	if wh.isDebugRequest(req) {
+		writer.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(writer).Encode(DebugInfo{
+			Command:  cmd.Args,
+			Env:      cmd.Env[inherited:],
+			WorkDir:  workDir,
+			Manifest: *manifest,
+		})
+	}
+
+	var stopFlushing = func() {}
+	if flusher, ok := writer.(pendingFlusher); ok && wh.config.FlushInterval > 0 {
+		stopFlushing = flushPeriodically(flusher, wh.config.FlushInterval)
+		defer stopFlushing()
+	}
+
+	stderr := internal.NewTailBuffer(stderrTailSize)
+	cmd.Stderr = stderr
+
+	started := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		if err := internal.SetPriority(cmd.Process.Pid, manifest.Nice, int(manifest.IOClass)); err != nil {
+			wh.config.Logger.Warn("failed set script priority", "path", req.URL.Path, "nice", manifest.Nice, "io_class", manifest.IOClass, "error", err)
+		}
+		err = cmd.Wait()
+		// periodic flush may write headers concurrently
+		stopFlushing()
+		code := exitCode(err)
+		wh.exitCodes.WithLabelValues(wh.metricsPath(req.URL.Path), code).Inc()
+		writer.Header().Set(ExitCodeHeader, code)
+	}
+	if err != nil {
+		wh.config.Logger.Error("script failed",
+			"path", req.URL.Path,
+			"attempt", req.Header.Get("X-Attempt"),
+			"exit_code", exitStatus(err),
+			"duration", time.Since(started),
+			"stderr", stderr.String(),
+			"error", err)
+	}
+	if limiter != nil && limiter.Exceeded() {
+		wh.truncatedNum.WithLabelValues(wh.metricsPath(req.URL.Path)).Inc()
+		wh.config.Logger.Warn("output limit exceeded, script terminated", "path", req.URL.Path, "limit", manifest.MaxResponse)
+		return fmt.Errorf("output limit %d bytes: %w", manifest.MaxResponse, ErrTooBigResponse)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%v: %w", err, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// exitStatus returns exit code of script for logs: -1 if script was terminated by signal or not started.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1
+	}
+	return exitErr.ExitCode()
+}
+
+// exitCode returns exit code of finished script, ExitCodeSignaled if script was terminated by signal or empty string
+// if script was not started.
+func exitCode(err error) string {
+	if err == nil {
+		return "0"
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return ""
+	}
+	if code := exitErr.ExitCode(); code >= 0 {
+		return strconv.Itoa(code)
+	}
+	return ExitCodeSignaled
+}
+
+// readCachedBody reads whole request body for caching arg types, respecting Config.MaxCachedBody.
+func (wh *Webhooks) readCachedBody(payload io.Reader) ([]byte, error) {
+	limit := wh.config.MaxCachedBody
+	if limit <= 0 {
+		return ioutil.ReadAll(payload)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(payload, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("cached body limit %d bytes: %w", limit, ErrTooBigRequest)
+	}
+	return data, nil
+}
+
+// isCachedBodyTooBig returns true if Content-Length of request exceeds Config.MaxCachedBody for caching arg types.
+func (wh *Webhooks) isCachedBodyTooBig(req *http.Request) bool {
+	if wh.config.MaxCachedBody <= 0 || !wh.config.ArgType.IsCachingType() {
+		return false
+	}
+	if wh.config.SkipBodylessPayload && isBodyless(req.Method) {
+		return false
+	}
+	return req.ContentLength > wh.config.MaxCachedBody
 }
 
 func (wh *Webhooks) tempDir(script string) (string, error) {
 	if !wh.config.TempDir {
 		return wh.config.WorkDir, nil
 	}
+	if err := wh.checkDisk(); err != nil {
+		return "", err
+	}
+	if active := atomic.AddInt64(&wh.tempDirs, 1); wh.config.MaxTempDirs > 0 && active > wh.config.MaxTempDirs {
+		atomic.AddInt64(&wh.tempDirs, -1)
+		return "", fmt.Errorf("%w: too many temp dirs (%d)", ErrNoResources, wh.config.MaxTempDirs)
+	}
 	tmpDir, err := ioutil.TempDir(wh.config.WorkDir, "")
 	if err != nil {
+		atomic.AddInt64(&wh.tempDirs, -1)
 		return "", fmt.Errorf("create temp dir: %w", err)
 	}
+	if wh.runAs != nil {
+		if err := internal.Chown(tmpDir, wh.runAs); err != nil {
+			_ = wh.cleanupTempDir(tmpDir)
+			return "", fmt.Errorf("chown temp dir %s: %w", tmpDir, err)
+		}
+		return tmpDir, nil
+	}
 	if !wh.config.RunAsFileOwner {
 		return tmpDir, nil
 	}
 	if err := internal.ChownAsFile(tmpDir, script); err != nil {
-		_ = os.RemoveAll(tmpDir)
+		_ = wh.cleanupTempDir(tmpDir)
 		return "", fmt.Errorf("chown temp dir %s based on uid/gid from %s: %w", tmpDir, script, err)
 	}
 	return tmpDir, nil
 }
 
+// checkDisk checks that there is enough free space for new temp dir.
+func (wh *Webhooks) checkDisk() error {
+	if wh.config.MinFreeSpace == 0 {
+		return nil
+	}
+	parentDir := wh.config.WorkDir
+	if parentDir == "" {
+		parentDir = os.TempDir()
+	}
+	free, err := internal.FreeSpace(parentDir)
+	if errors.Is(err, internal.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("detect free space: %w", err)
+	}
+	if free < wh.config.MinFreeSpace {
+		return fmt.Errorf("%w: free space %d bytes is less than %d bytes", ErrNoResources, free, wh.config.MinFreeSpace)
+	}
+	return nil
+}
+
 func (wh *Webhooks) cleanupTempDir(dir string) error {
 	if !wh.config.TempDir {
 		return nil
 	}
+	defer atomic.AddInt64(&wh.tempDirs, -1)
 	return os.RemoveAll(dir)
 }
 
+// payloadFile stores request body to new temp file (readable only by owner) in work dir and returns path to it.
+func (wh *Webhooks) payloadFile(workDir string, script string, payload io.Reader) (string, error) {
+	file, err := ioutil.TempFile(workDir, "payload-")
+	if err != nil {
+		return "", fmt.Errorf("create payload file: %w", err)
+	}
+	_, err = io.Copy(file, payload)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && wh.runAs != nil {
+		err = internal.Chown(file.Name(), wh.runAs)
+	} else if err == nil && wh.config.RunAsFileOwner {
+		err = internal.ChownAsFile(file.Name(), script)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("store payload file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// CheckRunAs returns error if scripts can not be run as Config.RunAsUser and Config.RunAsGroup: unknown user or group,
+// conflict with Config.RunAsFileOwner or not supported platform (internal.ErrUnsupported wrapped).
+func (wh *Webhooks) CheckRunAs() error {
+	return wh.runAsErr
+}
+
 func (wh *Webhooks) setRunCredentials(cmd *exec.Cmd, script string) error {
-	if !wh.config.RunAsFileOwner {
+	if wh.runAsErr != nil {
+		return wh.runAsErr
+	}
+	if wh.runAs != nil {
+		internal.SetCredential(cmd, wh.runAs)
+	} else if !wh.config.RunAsFileOwner {
+		return nil
+	} else if err := internal.SetCreds(cmd, script); err != nil {
+		return err
+	}
+	if wh.config.NoSupplementaryGroups {
 		return nil
 	}
-	return internal.SetCreds(cmd, script)
+	if err := internal.SetSupplementaryGroups(cmd); err != nil {
+		wh.config.Logger.Warn("failed set supplementary groups, only primary group used", "script", script, "error", err)
+	}
+	return nil
+}
+
+func (wh *Webhooks) lookPath(binary string) (string, error) {
+	if wh.config.ExecPath == "" || filepath.Base(binary) != binary {
+		return binary, nil
+	}
+	return internal.LookPath(binary, wh.config.ExecPath)
+}
+
+func (wh *Webhooks) notFound(writer http.ResponseWriter, req *http.Request) {
+	if wh.config.NotFoundHandler != nil {
+		wh.config.NotFoundHandler.ServeHTTP(writer, req)
+		return
+	}
+	http.NotFound(writer, req)
+}
+
+// bufferSize for response based on client hints: query param stream=(1|y|yes|true|ok|on) or Accept: text/event-stream
+// disables buffering, query param buffer=<bytes> sets buffer size, limited by MaxBufferSize.
+func (wh *Webhooks) bufferSize(req *http.Request) int {
+	query := req.URL.Query()
+	if parseBool(query.Get("stream")) || strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return 0
+	}
+	hint := query.Get("buffer")
+	if hint == "" {
+		return wh.config.BufferSize
+	}
+	size, err := strconv.Atoi(hint)
+	if err != nil || size < 0 {
+		wh.config.Logger.Warn("ignoring invalid buffer size hint", "path", req.URL.Path, "hint", hint)
+		return wh.config.BufferSize
+	}
+	maxSize := wh.config.MaxBufferSize
+	if maxSize < wh.config.BufferSize {
+		maxSize = wh.config.BufferSize
+	}
+	if size > maxSize {
+		return maxSize
+	}
+	return size
+}
+
+// applyTimeoutHint reduces manifest timeout by client hint: query param timeout or header X-Timeout as duration.
+// Hints bigger than manifest timeout are ignored.
+func (wh *Webhooks) applyTimeoutHint(manifest *Manifest, req *http.Request) {
+	hint := req.URL.Query().Get("timeout")
+	if hint == "" {
+		hint = req.Header.Get("X-Timeout")
+	}
+	if hint == "" {
+		return
+	}
+	timeout, err := time.ParseDuration(hint)
+	if err != nil || timeout <= 0 {
+		wh.config.Logger.Warn("ignoring invalid timeout hint", "path", req.URL.Path, "hint", hint)
+		return
+	}
+	if manifest.Timeout <= 0 || timeout < manifest.Timeout {
+		manifest.Timeout = timeout
+	}
+}
+
+// checkQuery returns false and first unexpected query param in case strict query enabled.
+func (wh *Webhooks) checkQuery(manifest *Manifest, req *http.Request) (string, bool) {
+	if !wh.config.StrictQuery || (len(wh.config.AllowedQuery) == 0 && len(manifest.Query) == 0) {
+		return "", true
+	}
+	for param := range req.URL.Query() {
+		switch param {
+		case "async", "stream", "buffer", "timeout":
+			continue
+		}
+		if !contains(wh.config.AllowedQuery, param) && !contains(manifest.Query, param) {
+			return param, false
+		}
+	}
+	return "", true
+}
+
+func (wh *Webhooks) headersLimit() int {
+	if wh.config.BufferSize > 0 {
+		return wh.config.BufferSize
+	}
+	return DefaultHeadersSize
 }
 
 func (wh *Webhooks) defaultManifest() Manifest {
@@ -361,17 +1405,323 @@ func (wh *Webhooks) defaultManifest() Manifest {
 		Timeout: wh.config.Timeout,
 		Retries: wh.config.Retries,
 		Delay:   wh.config.Delay,
+
+		MaxResponse: wh.config.MaxResponseSize,
+		Nice:        wh.config.Nice,
+		IOClass:     wh.config.IOClass,
+		Backoff:     wh.config.Backoff,
+		Callback:    wh.config.CompletionCallback,
+		RateLimit:   wh.config.RateLimit,
+	}
+}
+
+// appendValues appends values as environment variable name according to Config.MultiValueEncoding.
+func (wh *Webhooks) appendValues(env []string, name string, values []string) []string {
+	env = append(env, name+"="+strings.Join(values, ","))
+	if wh.config.MultiValueEncoding == MultiValueIndexed {
+		for i, value := range values {
+			env = append(env, name+"_"+strconv.Itoa(i)+"="+value)
+		}
+	}
+	return env
+}
+
+func (wh *Webhooks) traceID(req *http.Request) string {
+	if wh.config.TraceID == nil {
+		return ""
+	}
+	return wh.config.TraceID(req)
+}
+
+// observe value with trace ID as exemplar (if defined).
+func observe(observer prometheus.Observer, value float64, traceID string) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(value)
+}
+
+// TraceParentID returns trace ID from W3C Trace Context header (traceparent) or empty string if header is not defined
+// or invalid. Can be used as Config.TraceID.
+func TraceParentID(req *http.Request) string {
+	parts := strings.Split(req.Header.Get("Traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
 	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return strings.ToLower(parts[1])
+}
+
+func (wh *Webhooks) metricsPath(path string) string {
+	if wh.config.MetricsPath == nil {
+		return path
+	}
+	return wh.config.MetricsPath(path)
+}
+
+// PathPatterns returns function for Config.MetricsPath which replaces path by the first matched pattern. Pattern
+// segments starting with colon (ex: /user/:id) match any single segment, other segments should match exactly.
+// Paths without matched patterns are returned as-is.
+func PathPatterns(patterns ...string) func(path string) string {
+	var parsed = make([][]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		parsed = append(parsed, pathSegments(pattern))
+	}
+	return func(path string) string {
+		segments := pathSegments(path)
+		for i, pattern := range parsed {
+			if matchSegments(pattern, segments) {
+				return patterns[i]
+			}
+		}
+		return path
+	}
+}
+
+// pathSegments splits path to segments without leading and trailing slashes.
+func pathSegments(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, segment := range pattern {
+		if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// appendClientCert adds common name, comma-separated subject alternative names (DNS names, emails, IPs and URIs),
+// serial number (hex) and optionally PEM (see Config.ClientCertPEM) of verified client certificate. Not verified
+// certificates are ignored.
+func (wh *Webhooks) appendClientCert(env []string, req *http.Request) []string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return env
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	var serial string
+	if cert.SerialNumber != nil {
+		serial = strings.ToUpper(cert.SerialNumber.Text(16))
+	}
+	env = append(env,
+		"CLIENT_CERT_CN="+cert.Subject.CommonName,
+		"CLIENT_CERT_SAN="+strings.Join(names, ","),
+		"CLIENT_CERT_SERIAL="+serial)
+	if wh.config.ClientCertPEM && len(cert.Raw) > 0 {
+		env = append(env, "CLIENT_CERT_PEM="+string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+	return env
+}
+
+func (wh *Webhooks) isDebugRequest(req *http.Request) bool {
+	return wh.config.AllowDebug && req.Header.Get(DebugHeader) != ""
+}
+
+// isHeaderExported checks that header should be passed to environment (see Config.HeaderEnvPattern).
+func (wh *Webhooks) isHeaderExported(name string) bool {
+	return wh.config.HeaderEnvPattern == nil || name == "X-Attempt" || wh.config.HeaderEnvPattern.MatchString(name)
+}
+
+// clientIP returns the rightmost address from X-Forwarded-For which is not trusted proxy in case direct peer is trusted
+// proxy, otherwise - peer IP.
+func (wh *Webhooks) clientIP(req *http.Request) string {
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !wh.isTrustedProxy(peer) {
+		return peer
+	}
+	if wh.config.TrustForwarded && req.Header.Get("X-Forwarded-For") == "" {
+		if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+			return realIP
+		}
+	}
+	forwarded := headerList(req, "X-Forwarded-For")
+	if i := wh.forwardedClient(forwarded); i >= 0 {
+		return forwarded[i]
+	}
+	return peer
+}
+
+// forwardedClient returns index of the rightmost address in X-Forwarded-For list which is not trusted proxy or index of
+// the leftmost address if all addresses are trusted. Returns -1 for empty list.
+func (wh *Webhooks) forwardedClient(forwarded []string) int {
+	i := len(forwarded) - 1
+	for i > 0 && wh.isTrustedProxy(forwarded[i]) {
+		i--
+	}
+	return i
+}
+
+// requestScheme returns scheme of original request: from X-Forwarded-Proto if forwarded headers are trusted and
+// direct peer is trusted proxy, otherwise by connection.
+func (wh *Webhooks) requestScheme(req *http.Request) string {
+	if proto := wh.forwardedValue(req, "X-Forwarded-Proto"); proto != "" {
+		return strings.ToLower(proto)
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns host of original request: from X-Forwarded-Host if forwarded headers are trusted and direct peer
+// is trusted proxy, otherwise Host header.
+func (wh *Webhooks) requestHost(req *http.Request) string {
+	if host := wh.forwardedValue(req, "X-Forwarded-Host"); host != "" {
+		return host
+	}
+	return req.Host
+}
+
+// forwardedValue returns value of forwarded header set by the proxy which accepted request from client (see clientIP)
+// if it's trusted. Proxies append values in step with X-Forwarded-For, so the value has the same position from the
+// right as client address. Values on the left could be sent by client itself.
+func (wh *Webhooks) forwardedValue(req *http.Request, header string) string {
+	if !wh.config.TrustForwarded {
+		return ""
+	}
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !wh.isTrustedProxy(peer) {
+		return ""
+	}
+	values := headerList(req, header)
+	if len(values) == 0 {
+		return ""
+	}
+	var hop int // position from the right
+	forwarded := headerList(req, "X-Forwarded-For")
+	if i := wh.forwardedClient(forwarded); i >= 0 {
+		hop = len(forwarded) - 1 - i
+	}
+	if hop >= len(values) {
+		// not all proxies append header
+		return values[0]
+	}
+	return values[len(values)-1-hop]
+}
+
+// headerList returns non-empty comma-separated values of all header lines.
+func headerList(req *http.Request, header string) []string {
+	var list []string
+	for _, value := range strings.Split(strings.Join(req.Header.Values(header), ","), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func (wh *Webhooks) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range wh.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits comma-separated list and trims spaces. Empty items are ignored.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func toEnv(name string) string {
 	return strings.ReplaceAll(strings.ToUpper(name), "-", "_")
 }
 
+// isBodyless returns true for methods which should not have request body.
+func isBodyless(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsCachingType returns true if request body should be fully read to memory before execution.
 func (at ArgType) IsCachingType() bool {
 	return at == ArgTypeEnv || at == ArgTypeParam
 }
 
+var ErrUnknownIOClass = errors.New("IO class unknown")
+
+func (class *IOClass) UnmarshalText(data []byte) error {
+	switch string(data) {
+	case "", "default":
+		*class = IOClassDefault
+	case "realtime":
+		*class = IOClassRealtime
+	case "best-effort":
+		*class = IOClassBestEffort
+	case "idle":
+		*class = IOClassIdle
+	default:
+		return ErrUnknownIOClass
+	}
+	return nil
+}
+
+func (class IOClass) MarshalText() ([]byte, error) {
+	return []byte(class.String()), nil
+}
+
+func (class IOClass) String() string {
+	switch class {
+	case IOClassDefault:
+		return "default"
+	case IOClassRealtime:
+		return "realtime"
+	case IOClassBestEffort:
+		return "best-effort"
+	case IOClassIdle:
+		return "idle"
+	default:
+		return "unknown(" + strconv.Itoa(int(class)) + ")"
+	}
+}
+
 var ErrUnknownAsyncMode = errors.New("async mode unknown")
 
 func (mode *AsyncMode) UnmarshalText(data []byte) error {
@@ -388,6 +1738,10 @@ func (mode *AsyncMode) UnmarshalText(data []byte) error {
 	return nil
 }
 
+func (mode AsyncMode) MarshalText() ([]byte, error) {
+	return []byte(mode.String()), nil
+}
+
 func (mode AsyncMode) String() string {
 	switch mode {
 
@@ -401,3 +1755,32 @@ func (mode AsyncMode) String() string {
 		return "unknown(" + strconv.Itoa(int(mode)) + ")"
 	}
 }
+
+type pendingFlusher interface {
+	FlushPending() error
+}
+
+// flushPeriodically flushes pending output each interval till returned stop function called. Stop function waits
+// till the last flush finished and can be called several times.
+func flushPeriodically(flusher pendingFlusher, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = flusher.FlushPending()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+}